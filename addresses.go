@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// AddressSet is the in-memory set of watched addresses (lowercase, without
+// 0x prefix), so notifications are filtered without querying the database.
+type AddressSet struct {
+	mu        sync.RWMutex
+	addresses map[string]bool
+}
+
+func NewAddressSet() *AddressSet {
+	return &AddressSet{addresses: make(map[string]bool)}
+}
+
+func (set *AddressSet) Contains(address string) bool {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	return set.addresses[NormalizeAsset(address)]
+}
+
+func (set *AddressSet) Add(address string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	set.addresses[NormalizeAsset(address)] = true
+}
+
+func (set *AddressSet) Len() int {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	return len(set.addresses)
+}
+
+// Load adds the addresses stored in database to the set. They are merged
+// under the lock rather than swapped in: an address added while they were
+// read is kept.
+func (set *AddressSet) Load(db Store) error {
+	stored, err := db.GetAddresses()
+	if err != nil {
+		return err
+	}
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	for _, address := range stored {
+		set.addresses[NormalizeAsset(address)] = true
+	}
+
+	return nil
+}
+
+// AddressRefresher reloads the set periodically, to pick up the addresses
+// inserted by other instances.
+func AddressRefresher(config *Config, db Store, set *AddressSet) {
+	if config.AddressRefreshInterval == 0 {
+		return
+	}
+
+	for {
+		time.Sleep(config.AddressRefreshInterval)
+
+		err := set.Load(db)
+		if err != nil {
+			log.Println("AddressRefresher:", err)
+		}
+	}
+}
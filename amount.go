@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+)
+
+// Decimals of the ETH units accepted by /sendEth.
+var ETH_UNITS = map[string]uint8{
+	"wei":   0,
+	"gwei":  9,
+	"ether": 18,
+}
+
+const ETH_DECIMALS = 18
+
+// ParseAmount converts a decimal amount, such as "0.1", into base units: an
+// amount with decimals digits after the point is an integer number of base
+// units. Negative amounts and digits beyond decimals are rejected, instead of
+// being rounded.
+func ParseAmount(amount string, decimals uint8) (*big.Int, error) {
+	integer, fraction := amount, ""
+	if i := strings.IndexByte(amount, '.'); i >= 0 {
+		integer, fraction = amount[:i], amount[i+1:]
+	}
+
+	if integer == "" && fraction == "" || false == isDigits(integer) || false == isDigits(fraction) {
+		return nil, ErrInvalidRequest.Errorf("Invalid amount %s: Not a positive decimal number", amount)
+	}
+
+	// Trailing zeros do not add precision.
+	fraction = strings.TrimRight(fraction, "0")
+	if len(fraction) > int(decimals) {
+		return nil, ErrInvalidRequest.Errorf("Invalid amount %s: At most %d decimals are allowed", amount, decimals)
+	}
+
+	digits := integer + fraction + strings.Repeat("0", int(decimals)-len(fraction))
+
+	value, ok := new(big.Int).SetString(digits, 10)
+	if false == ok {
+		return nil, ErrInvalidRequest.Errorf("Invalid amount %s: Not a positive decimal number", amount)
+	}
+
+	return value, nil
+}
+
+// FormatAmount converts base units into a decimal amount, without trailing
+// zeros: FormatAmount(100000000000000000, 18) is "0.1".
+func FormatAmount(amount *big.Int, decimals uint8) string {
+	digits := new(big.Int).Abs(amount).Text(10)
+	if len(digits) <= int(decimals) {
+		digits = strings.Repeat("0", int(decimals)-len(digits)+1) + digits
+	}
+
+	integer := digits[:len(digits)-int(decimals)]
+	fraction := strings.TrimRight(digits[len(digits)-int(decimals):], "0")
+
+	formatted := integer
+	if fraction != "" {
+		formatted += "." + fraction
+	}
+
+	if amount.Sign() < 0 {
+		formatted = "-" + formatted
+	}
+
+	return formatted
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		amount   string
+		decimals uint8
+		expected string
+	}{
+		{"0.1", 18, "100000000000000000"},
+		{"1", 18, "1000000000000000000"},
+		{".5", 18, "500000000000000000"},
+		{"5.", 18, "5000000000000000000"},
+		{"1.500", 2, "150"},
+		{"0.000000000000000001", 18, "1"},
+		{"1.000000000000000000000", 18, "1000000000000000000"},
+		{"42", 0, "42"},
+		{"42.0", 0, "42"},
+		{"007", 2, "700"},
+		{"0", 18, "0"},
+	}
+
+	for _, test := range tests {
+		value, err := ParseAmount(test.amount, test.decimals)
+		if err != nil {
+			t.Errorf("ParseAmount(%q, %d): %v", test.amount, test.decimals, err)
+			continue
+		}
+
+		if value.Text(10) != test.expected {
+			t.Errorf("ParseAmount(%q, %d) = %s, expected %s", test.amount, test.decimals, value.Text(10), test.expected)
+		}
+	}
+}
+
+func TestParseAmountInvalid(t *testing.T) {
+	tests := []struct {
+		amount   string
+		decimals uint8
+	}{
+		{"", 18},
+		{".", 18},
+		{"-1", 18},
+		{"+1", 18},
+		{"1e18", 18},
+		{"0x10", 18},
+		{"1.2.3", 18},
+		{" 1", 18},
+		{"1,5", 18},
+		{"0.0000000000000000001", 18},
+		{"1.5", 0},
+		{"0.001", 2},
+	}
+
+	for _, test := range tests {
+		value, err := ParseAmount(test.amount, test.decimals)
+		if err == nil {
+			t.Errorf("ParseAmount(%q, %d) = %s, expected an error", test.amount, test.decimals, value.Text(10))
+			continue
+		}
+
+		if false == errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("ParseAmount(%q, %d): %v is not an invalid request", test.amount, test.decimals, err)
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		amount   string
+		decimals uint8
+		expected string
+	}{
+		{"100000000000000000", 18, "0.1"},
+		{"1000000000000000000", 18, "1"},
+		{"1", 18, "0.000000000000000001"},
+		{"6099990000000000000", 18, "6.09999"},
+		{"0", 18, "0"},
+		{"13", 4, "0.0013"},
+		{"150", 2, "1.5"},
+		{"42", 0, "42"},
+		{"-1500", 3, "-1.5"},
+	}
+
+	for _, test := range tests {
+		amount, _ := new(big.Int).SetString(test.amount, 10)
+
+		formatted := FormatAmount(amount, test.decimals)
+		if formatted != test.expected {
+			t.Errorf("FormatAmount(%s, %d) = %s, expected %s", test.amount, test.decimals, formatted, test.expected)
+		}
+	}
+}
+
+func TestFormatAmountRoundTrip(t *testing.T) {
+	amounts := []string{"0", "1", "10", "999", "100000000000000000", "123456789012345678901234567890"}
+
+	for _, decimals := range []uint8{0, 2, 6, 18} {
+		for _, a := range amounts {
+			amount, _ := new(big.Int).SetString(a, 10)
+
+			value, err := ParseAmount(FormatAmount(amount, decimals), decimals)
+			if err != nil {
+				t.Errorf("ParseAmount(FormatAmount(%s, %d)): %v", a, decimals, err)
+				continue
+			}
+
+			if value.Cmp(amount) != 0 {
+				t.Errorf("ParseAmount(FormatAmount(%s, %d)) = %s", a, decimals, value.Text(10))
+			}
+		}
+	}
+}
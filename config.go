@@ -1,18 +1,129 @@
 package main
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"gopkg.in/ini.v1"
 )
 
-type Config struct {
-	WebsocketURL string
+const (
+	DEFAULT_REQUIRED_CONFIRMATIONS = 12
+	DEFAULT_MAX_REPLACEMENTS       = 3
+
+	DEFAULT_RPC_TIMEOUT = 30 * time.Second
+
+	DEFAULT_POLL_INTERVAL          = 2 * time.Second
+	DEFAULT_WEBSOCKET_MAX_FAILURES = 3
+
+	DEFAULT_NODE_CHECK_INTERVAL = 15 * time.Second
+	DEFAULT_NODE_MAX_HEAD_LAG   = 3
+	DEFAULT_NODE_MAX_LATENCY    = 2 * time.Second
+	DEFAULT_NODE_MAX_ERROR_RATE = 0.5
+
+	DEFAULT_TX_WORKERS              = 8
+	DEFAULT_TX_QUEUE_SIZE           = 4096
+	DEFAULT_BLOCK_FETCH_CONCURRENCY = 8
+
+	DEFAULT_ADDRESS_REFRESH_INTERVAL = time.Minute
+
+	DEFAULT_WEBHOOK_TIMEOUT         = 10 * time.Second
+	DEFAULT_WEBHOOK_MAX_ATTEMPTS    = 10
+	DEFAULT_WEBHOOK_RETRY_DELAY     = 10 * time.Second
+	DEFAULT_WEBHOOK_MAX_RETRY_DELAY = time.Hour
+)
+
+// NodeConfig is an upstream Ethereum node.
+type NodeConfig struct {
+	Name         string
 	RPCURL       string
+	WebsocketURL string
+	// Healthy nodes with the lowest priority are used first.
+	Priority int
+}
+
+type Config struct {
+	// Upstream nodes, by priority.
+	Nodes []NodeConfig
+
+	// A node is unhealthy when its head is more than NodeMaxHeadLag blocks
+	// behind the best one, it answers slower than NodeMaxLatency, or more
+	// than NodeMaxErrorRate of its recent health checks failed.
+	NodeCheckInterval time.Duration
+	NodeMaxHeadLag    uint64
+	NodeMaxLatency    time.Duration
+	NodeMaxErrorRate  float64
+
+	// Chain id used to sign transactions; retrieved from the node when 0.
+	ChainID uint64
+
+	// The RPC API is polled every PollInterval when no WebsocketURL is set,
+	// or after WebsocketMaxFailures failed connections in a row.
+	PollInterval         time.Duration
+	WebsocketMaxFailures int
+
+	// Pending transactions are looked up by TxWorkers workers, queued up to
+	// TxQueueSize; up to BlockFetchConcurrency blocks are read at once when
+	// catching up.
+	TxWorkers             int
+	TxQueueSize           int
+	BlockFetchConcurrency int
+
+	// Watched addresses are reloaded from database at this interval, to
+	// pick up the ones inserted by other instances; 0 disables it.
+	AddressRefreshInterval time.Duration
 
+	DBDriver   string
 	DBHostname string
 	DBProtocol string
 	DBName     string
 	DBUser     string
 	DBPass     string
+	DBSSLMode  string
+
+	// Confirmations required before a notification is final, per asset
+	// ("eth" or a lowercase contract address without 0x prefix).
+	DefaultConfirmations  uint64
+	RequiredConfirmations map[string]uint64
+
+	// Failed (reverted) transactions are either notified with a "failed"
+	// status, or not notified at all.
+	SuppressFailedTransactions bool
+
+	// Notifications acknowledged by every consumer are deleted after this
+	// delay; 0 keeps them forever.
+	NotificationRetention time.Duration
+	// Consumers which acknowledged nothing for this delay are removed, so
+	// they don't hold back the deletion of notifications; 0 keeps them.
+	ConsumerExpiry time.Duration
+
+	// Accept raw private keys in send requests, rather than only signing
+	// with keys stored in database.
+	AllowPrivateKeys bool
+	// Node calls made by an API request, the listener, the fetchers and the
+	// tracker are cancelled after this delay.
+	RPCTimeout time.Duration
+
+	// Master key used to encrypt private keys at rest, and the previous one,
+	// still decrypting the keys not rotated yet.
+	MasterKey                KeySource
+	MasterKeyVersion         int
+	PreviousMasterKey        KeySource
+	PreviousMasterKeyVersion int
+
+	// Pending outgoing transactions are sped up after this many blocks
+	// (0 disables it), at most MaxReplacements times per nonce.
+	AutoSpeedUpBlocks uint64
+	MaxReplacements   int
+
+	// Webhook deliveries are retried with an exponential backoff starting
+	// at WebhookRetryDelay, and are dead after WebhookMaxAttempts.
+	WebhookTimeout       time.Duration
+	WebhookMaxAttempts   int
+	WebhookRetryDelay    time.Duration
+	WebhookMaxRetryDelay time.Duration
 }
 
 func LoadConfiguration(filepath string) (*Config, error) {
@@ -23,14 +134,167 @@ func LoadConfiguration(filepath string) (*Config, error) {
 
 	config := new(Config)
 
-	config.RPCURL = cfg.Section("network").Key("rpc_host").String()
-	config.WebsocketURL = cfg.Section("network").Key("websocket_host").String()
+	config.Nodes, err = loadNodes(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	config.NodeCheckInterval = cfg.Section("nodes").Key("check_interval").MustDuration(DEFAULT_NODE_CHECK_INTERVAL)
+	config.NodeMaxHeadLag = cfg.Section("nodes").Key("max_head_lag").MustUint64(DEFAULT_NODE_MAX_HEAD_LAG)
+	config.NodeMaxLatency = cfg.Section("nodes").Key("max_latency").MustDuration(DEFAULT_NODE_MAX_LATENCY)
+	config.NodeMaxErrorRate = cfg.Section("nodes").Key("max_error_rate").MustFloat64(DEFAULT_NODE_MAX_ERROR_RATE)
+
+	if config.NodeCheckInterval <= 0 || config.NodeMaxLatency <= 0 || config.NodeMaxErrorRate < 0 || config.NodeMaxErrorRate > 1 {
+		return nil, fmt.Errorf("Invalid [nodes] section: check_interval and max_latency must be positive, and max_error_rate between 0 and 1")
+	}
+
+	config.ChainID = cfg.Section("network").Key("chain_id").MustUint64(0)
+	config.PollInterval = cfg.Section("network").Key("poll_interval").MustDuration(DEFAULT_POLL_INTERVAL)
+	config.WebsocketMaxFailures = cfg.Section("network").Key("websocket_max_failures").MustInt(DEFAULT_WEBSOCKET_MAX_FAILURES)
+
+	if config.PollInterval <= 0 || config.WebsocketMaxFailures <= 0 {
+		return nil, fmt.Errorf("Invalid [network] section: poll_interval and websocket_max_failures must be positive")
+	}
+
+	config.TxWorkers = cfg.Section("listener").Key("tx_workers").MustInt(DEFAULT_TX_WORKERS)
+	config.TxQueueSize = cfg.Section("listener").Key("tx_queue_size").MustInt(DEFAULT_TX_QUEUE_SIZE)
+	config.BlockFetchConcurrency = cfg.Section("listener").Key("block_fetch_concurrency").MustInt(DEFAULT_BLOCK_FETCH_CONCURRENCY)
+
+	if config.TxWorkers <= 0 || config.TxQueueSize <= 0 || config.BlockFetchConcurrency <= 0 {
+		return nil, fmt.Errorf("Invalid [listener] section: tx_workers, tx_queue_size and block_fetch_concurrency must be positive")
+	}
+
+	config.AddressRefreshInterval = cfg.Section("addresses").Key("refresh_interval").MustDuration(DEFAULT_ADDRESS_REFRESH_INTERVAL)
 
+	config.DBDriver = cfg.Section("db").Key("driver").MustString("mysql")
 	config.DBHostname = cfg.Section("db").Key("host").String()
 	config.DBProtocol = cfg.Section("db").Key("protocol").String()
 	config.DBName = cfg.Section("db").Key("name").String()
 	config.DBUser = cfg.Section("db").Key("user").String()
 	config.DBPass = cfg.Section("db").Key("pass").String()
+	config.DBSSLMode = cfg.Section("db").Key("sslmode").String()
+
+	config.DefaultConfirmations = DEFAULT_REQUIRED_CONFIRMATIONS
+	config.RequiredConfirmations = make(map[string]uint64)
+
+	for _, key := range cfg.Section("confirmations").Keys() {
+		value, err := key.Uint64()
+		if err != nil {
+			return nil, err
+		}
+
+		if key.Name() == "default" {
+			config.DefaultConfirmations = value
+			continue
+		}
+
+		config.RequiredConfirmations[NormalizeAsset(key.Name())] = value
+	}
+
+	switch policy := cfg.Section("notifications").Key("failed_transactions").MustString("flag"); policy {
+	case "flag":
+		config.SuppressFailedTransactions = false
+	case "suppress":
+		config.SuppressFailedTransactions = true
+	default:
+		return nil, fmt.Errorf("Invalid failed_transactions policy '%s': Must be 'flag' or 'suppress'", policy)
+	}
+
+	config.NotificationRetention = cfg.Section("notifications").Key("retention").MustDuration(0)
+	config.ConsumerExpiry = cfg.Section("notifications").Key("consumer_expiry").MustDuration(0)
+
+	config.AllowPrivateKeys = cfg.Section("api").Key("allow_private_keys").MustBool(true)
+	config.RPCTimeout = cfg.Section("api").Key("rpc_timeout").MustDuration(DEFAULT_RPC_TIMEOUT)
+
+	if config.RPCTimeout <= 0 {
+		return nil, fmt.Errorf("Invalid [api] section: rpc_timeout must be positive")
+	}
+
+	config.MasterKey = KeySource{
+		File:       cfg.Section("keys").Key("master_key_file").String(),
+		Env:        cfg.Section("keys").Key("master_key_env").String(),
+		Passphrase: cfg.Section("keys").Key("master_key_passphrase").String(),
+		Salt:       cfg.Section("keys").Key("master_key_salt").String(),
+	}
+	config.MasterKeyVersion = cfg.Section("keys").Key("master_key_version").MustInt(1)
+
+	config.PreviousMasterKey = KeySource{
+		File:       cfg.Section("keys").Key("previous_master_key_file").String(),
+		Env:        cfg.Section("keys").Key("previous_master_key_env").String(),
+		Passphrase: cfg.Section("keys").Key("previous_master_key_passphrase").String(),
+		Salt:       cfg.Section("keys").Key("previous_master_key_salt").String(),
+	}
+	config.PreviousMasterKeyVersion = cfg.Section("keys").Key("previous_master_key_version").MustInt(0)
+
+	config.AutoSpeedUpBlocks = cfg.Section("replacement").Key("auto_speed_up_blocks").MustUint64(0)
+	config.MaxReplacements = cfg.Section("replacement").Key("max_replacements").MustInt(DEFAULT_MAX_REPLACEMENTS)
+
+	config.WebhookTimeout = cfg.Section("webhooks").Key("timeout").MustDuration(DEFAULT_WEBHOOK_TIMEOUT)
+	config.WebhookMaxAttempts = cfg.Section("webhooks").Key("max_attempts").MustInt(DEFAULT_WEBHOOK_MAX_ATTEMPTS)
+	config.WebhookRetryDelay = cfg.Section("webhooks").Key("retry_delay").MustDuration(DEFAULT_WEBHOOK_RETRY_DELAY)
+	config.WebhookMaxRetryDelay = cfg.Section("webhooks").Key("max_retry_delay").MustDuration(DEFAULT_WEBHOOK_MAX_RETRY_DELAY)
+
+	if config.WebhookMaxAttempts <= 0 || config.WebhookRetryDelay <= 0 || config.WebhookMaxRetryDelay < config.WebhookRetryDelay {
+		return nil, fmt.Errorf("Invalid [webhooks] section: max_attempts and retry_delay must be positive, and max_retry_delay at least retry_delay")
+	}
 
 	return config, nil
 }
+
+// loadNodes reads the [node.<name>] sections, or the single node of the
+// [network] section when there is none.
+func loadNodes(cfg *ini.File) ([]NodeConfig, error) {
+	nodes := make([]NodeConfig, 0)
+
+	for _, section := range cfg.Sections() {
+		if false == strings.HasPrefix(section.Name(), "node.") {
+			continue
+		}
+
+		nodes = append(nodes, NodeConfig{
+			Name:         strings.TrimPrefix(section.Name(), "node."),
+			RPCURL:       section.Key("rpc_host").String(),
+			WebsocketURL: section.Key("websocket_host").String(),
+			Priority:     section.Key("priority").MustInt(0),
+		})
+	}
+
+	if len(nodes) == 0 {
+		nodes = append(nodes, NodeConfig{
+			Name:         "default",
+			RPCURL:       cfg.Section("network").Key("rpc_host").String(),
+			WebsocketURL: cfg.Section("network").Key("websocket_host").String(),
+		})
+	}
+
+	for _, node := range nodes {
+		if node.RPCURL == "" {
+			return nil, fmt.Errorf("Invalid node '%s': rpc_host is not set", node.Name)
+		}
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Priority < nodes[j].Priority
+	})
+
+	return nodes, nil
+}
+
+func NormalizeAsset(asset string) string {
+	return strings.TrimPrefix(strings.ToLower(asset), "0x")
+}
+
+// GetRequiredConfirmations returns the number of confirmations after which
+// a notification for the given contract (empty for ETH) is marked final.
+func (config *Config) GetRequiredConfirmations(contractAddress string) uint64 {
+	asset := "eth"
+	if contractAddress != "" {
+		asset = NormalizeAsset(contractAddress)
+	}
+
+	if value, ok := config.RequiredConfirmations[asset]; ok {
+		return value
+	}
+
+	return config.DefaultConfirmations
+}
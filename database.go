@@ -1,35 +1,194 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/big"
-
-	"database/sql"
-	_ "github.com/go-sql-driver/mysql"
+	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Store is the persistence layer of eth-watcher: keys, notifications,
+// outgoing transactions, webhooks and settings.
+type Store interface {
+	Close()
+
+	Migrations() ([]Migration, error)
+	AppliedMigrations() (map[int]bool, error)
+	ApplyMigration(migration Migration, up bool) error
+
+	InsertKey(address, private string) error
+	GetKey(address string) (string, error)
+	RotateKeys(keyring *Keyring) (int, error)
+	GetAddresses() ([]string, error)
+
+	InsertNotification(msg NotifyMessage) (uint64, error)
+	DeletePendingNotifications(txHash string) error
+	UpdateConfirmations(head uint64) ([]NotifyMessage, error)
+	OrphanNotifications(ancestor uint64) ([]NotifyMessage, error)
+	GetNotifications(after uint64, limit int, state string) ([]NotifyMessage, error)
+	PruneNotifications(before int64) (int64, error)
+
+	GetConsumers() ([]Consumer, error)
+	GetConsumer(name string) (Consumer, error)
+	AckNotifications(name string, id uint64) (Consumer, error)
+	DeleteConsumer(name string) error
+	PruneConsumers(before int64) ([]string, error)
+
+	InsertTransaction(tx OutgoingTransaction) error
+	UpdateTransaction(tx OutgoingTransaction) error
+	GetTransaction(hash string) (OutgoingTransaction, error)
+	GetTrackedTransactions() ([]OutgoingTransaction, error)
+
+	GetNonces(address string) (map[uint64]NonceReservation, error)
+	SetNonce(address string, nonce uint64, status string) error
+	PruneNonces(address string, below uint64) error
+
+	InsertWebhook(hook Webhook) error
+	DeleteWebhook(id string) error
+	GetWebhooks() ([]Webhook, error)
+	UpdateDelivery(delivery WebhookDelivery) error
+	GetDueDeliveries(now int64, limit int, skipped []string) ([]WebhookDelivery, error)
+	GetDeliveries(webhookID, status string) ([]WebhookDelivery, error)
+	ReplayDeliveries(webhookID string, id uint64) (int64, error)
+
+	GetSetting(name string) (string, error)
+	SetSetting(name, value string) error
+	SetLastBlock(number uint64, hash string, keep uint64) error
+	GetBlocks() (map[uint64]string, error)
+
+	Transient(err error) bool
+}
+
+// Dialect describes the SQL flavour of a database backend.
+type Dialect struct {
+	Name       string
+	DriverName string
+
+	// Numbered placeholders ($1, $2, ...) instead of '?'.
+	NumberedPlaceholders bool
+	// Max open connections (0 is unlimited).
+	MaxOpenConns int
+	// Inserted ids are read with RETURNING, the driver not supporting
+	// LastInsertId.
+	ReturningID bool
+
+	DSN func(config *Config) string
+
+	// OnConflictUpdate returns the clause turning an INSERT into an upsert.
+	OnConflictUpdate func(conflict []string, update []string) string
+	// OnConflictIgnore is the clause making an INSERT violating a unique key
+	// a no-op.
+	OnConflictIgnore string
+	// ForUpdate is the clause locking the rows selected until the end of
+	// the transaction, if the dialect has one.
+	ForUpdate string
+
+	// Transient tells whether a driver error may go away by itself (lock
+	// timeout, deadlock, server shutting down...).
+	Transient func(err error) bool
+}
+
+var dialects = map[string]*Dialect{}
+
+func RegisterDialect(dialect *Dialect) {
+	dialects[dialect.Name] = dialect
+}
+
+// Rebind rewrites '?' placeholders for the dialect.
+func (d *Dialect) Rebind(query string) string {
+	if false == d.NumberedPlaceholders {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// OnConflictDoUpdate is the standard upsert clause, shared by PostgreSQL and
+// SQLite.
+func OnConflictDoUpdate(conflict []string, update []string) string {
+	sets := make([]string, 0, len(update))
+	for _, column := range update {
+		sets = append(sets, fmt.Sprintf("%s = excluded.%s", column, column))
+	}
+
+	return fmt.Sprintf("ON CONFLICT(%s) DO UPDATE SET %s", strings.Join(conflict, ", "), strings.Join(sets, ", "))
+}
+
+// ON_CONFLICT_DO_NOTHING is the standard OnConflictIgnore clause, shared by
+// PostgreSQL and SQLite.
+const ON_CONFLICT_DO_NOTHING = "ON CONFLICT DO NOTHING"
+
+// Transient tells whether an error of the database may go away by itself,
+// the operation being worth retrying: a lost connection, or a driver error
+// the dialect knows to be temporary.
+func (db *DB) Transient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return db.dialect.Transient != nil && db.dialect.Transient(err)
+}
+
+// DB is the database/sql implementation of Store, shared by all dialects.
 type DB struct {
 	Interface *sql.DB
+	dialect   *Dialect
+	keyring   *Keyring
+
+	// Serializes the transactions recording notifications: ids are
+	// committed in order, so a reader after a cursor never skips an id
+	// committed after a greater one.
+	notificationsMu sync.Mutex
 }
 
 func DbOpen(config *Config) (*DB, error) {
-	dsn := fmt.Sprintf("%s:%s@%s(%s)/%s",
-		config.DBUser,
-		config.DBPass,
-		config.DBProtocol,
-		config.DBHostname,
-		config.DBName,
-	)
+	dialect, ok := dialects[config.DBDriver]
+	if false == ok {
+		return nil, fmt.Errorf("Unsupported database driver '%s'", config.DBDriver)
+	}
 
-	log.Printf("Connecting to DB using dsn: %s", dsn)
+	dsn := dialect.DSN(config)
 
-	dbInterface, err := sql.Open("mysql", dsn)
+	log.Printf("Connecting to %s DB using dsn: %s", dialect.Name, dsn)
+
+	dbInterface, err := sql.Open(dialect.DriverName, dsn)
 	if err != nil {
 		return nil, err
 	}
 
 	dbInterface.SetMaxIdleConns(100)
+	dbInterface.SetMaxOpenConns(dialect.MaxOpenConns)
 
 	err = dbInterface.Ping()
 	if err != nil {
@@ -40,6 +199,16 @@ func DbOpen(config *Config) (*DB, error) {
 
 	db := new(DB)
 	db.Interface = dbInterface
+	db.dialect = dialect
+
+	db.keyring, err = LoadKeyring(config)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load master key: %v", err)
+	}
+
+	if db.keyring == nil {
+		log.Println("Warning: No master key configured: private keys are stored in plaintext.")
+	}
 
 	return db, nil
 }
@@ -51,69 +220,186 @@ func (db *DB) Close() {
 	}
 }
 
-func (db *DB) InitTables() error {
-	queries := []string{`
-		CREATE TABLE eth_keys(
-			id INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
-			address VARCHAR(40) UNIQUE,
-			private VARCHAR(64)
-		);`,
-		`CREATE INDEX eth_keys_address_idx ON eth_keys(address);`,
-		`CREATE TABLE notifications(
-			id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
-			address_from     VARCHAR(40),
-			address_to       VARCHAR(40),
-			address_contract VARCHAR(40),
-			amount           VARCHAR(32),
-			is_pending       BOOLEAN NOT NULL DEFAULT false,
-			tx_hash          VARCHAR(64),
-			created_at       DATETIME DEFAULT NOW()
-		);`,
-		`CREATE TABLE settings(
-			id INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
-			name VARCHAR(32) UNIQUE,
-			value VARCHAR(64)
-		);`,
+func (db *DB) prepare(query string) (*sql.Stmt, error) {
+	return db.Interface.Prepare(db.dialect.Rebind(query))
+}
+
+func (db *DB) exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.Interface.Exec(db.dialect.Rebind(query), args...)
+}
+
+// sqlExecutor is implemented by both *sql.DB and *sql.Tx.
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// insert runs an INSERT into a table with an "id" column, and returns the
+// id of the new row, or 0 if no row was inserted.
+func (db *DB) insert(ex sqlExecutor, query string, args ...interface{}) (uint64, error) {
+	var id uint64
+
+	if db.dialect.ReturningID {
+		err := ex.QueryRow(db.dialect.Rebind(query+" RETURNING id"), args...).Scan(&id)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+
+		return id, err
+	}
+
+	res, err := ex.Exec(db.dialect.Rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil || affected == 0 {
+		return 0, err
+	}
+
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(lastID), nil
+}
+
+func (db *DB) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.Interface.Query(db.dialect.Rebind(query), args...)
+}
+
+func (db *DB) Migrations() ([]Migration, error) {
+	return LoadMigrations(db.dialect.Name)
+}
+
+func (db *DB) AppliedMigrations() (map[int]bool, error) {
+	_, err := db.Interface.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations(
+			version    INT NOT NULL PRIMARY KEY,
+			name       VARCHAR(128) NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
 
-	for _, query := range queries {
-		_, err := db.Interface.Query(query)
+	for rows.Next() {
+		var version int
+
+		err = rows.Scan(&version)
 		if err != nil {
-			return err
+			return nil, err
 		}
+
+		applied[version] = true
 	}
 
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(applied) == 0 {
+		// Schema created by the former -init flag: it matches the first migration.
+		rows, err := db.query("SELECT id FROM eth_keys LIMIT 1")
+		if err == nil {
+			rows.Close()
+
+			log.Println("Found a schema created by -init: marking migration 0001 as applied")
+
+			_, err = db.exec("INSERT INTO schema_migrations(version, name) VALUES (?, ?)", 1, "initial")
+			if err != nil {
+				return nil, err
+			}
+
+			applied[1] = true
+		}
+	}
+
+	return applied, nil
 }
 
-func (db *DB) InsertKey(address, private string) error {
-	stmt, err := db.Interface.Prepare("INSERT INTO eth_keys(address, private) VALUES(LOWER(?), ?) ON DUPLICATE KEY UPDATE private = ?")
+func (db *DB) ApplyMigration(migration Migration, up bool) error {
+	content := migration.Up
+	if false == up {
+		content = migration.Down
+	}
+
+	tx, err := db.Interface.Begin()
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
+
+	for _, statement := range SplitStatements(content) {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("%v (in: %s)", err, statement)
+		}
+	}
 
-	_, err = stmt.Exec(address, private, private)
+	if up {
+		_, err = tx.Exec(db.dialect.Rebind("INSERT INTO schema_migrations(version, name) VALUES (?, ?)"), migration.Version, migration.Name)
+	} else {
+		_, err = tx.Exec(db.dialect.Rebind("DELETE FROM schema_migrations WHERE version = ?"), migration.Version)
+	}
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func (db *DB) InsertNotification(
-	address_from, address_to, address_contract, amount string,
-	is_pending bool, tx_hash string) error {
+// encryptKey returns the private key as stored in database, and the version
+// of the master key it is encrypted with (0 when stored in plaintext).
+func encryptKey(keyring *Keyring, address, private string) (string, int, error) {
+	if private == "" || keyring == nil {
+		return private, 0, nil
+	}
+
+	ciphertext, err := keyring.Encrypt(address, private)
+	if err != nil {
+		return "", 0, fmt.Errorf("Could not encrypt private key: %v", err)
+	}
+
+	return ciphertext, keyring.Version, nil
+}
+
+func decryptKey(keyring *Keyring, address, value string, version int) (string, error) {
+	if version == 0 {
+		return value, nil
+	}
+
+	if keyring == nil || false == keyring.HasVersion(version) {
+		return "", fmt.Errorf("Private key of %s is encrypted with master key version %d, which is not loaded", address, version)
+	}
+
+	return keyring.Decrypt(version, address, value)
+}
+
+func (db *DB) InsertKey(address, private string) error {
+	value, version, err := encryptKey(db.keyring, strings.ToLower(address), private)
+	if err != nil {
+		return err
+	}
 
-	stmt, err := db.Interface.Prepare(`
-		INSERT INTO notifications(address_from, address_to, address_contract, amount, is_pending, tx_hash)
-		VALUES(?, ?, ?, ?, ?, ?)`)
+	stmt, err := db.prepare("INSERT INTO eth_keys(address, private, key_version) VALUES(LOWER(?), ?, ?) " +
+		db.dialect.OnConflictUpdate([]string{"address"}, []string{"private", "key_version"}))
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(address_from, address_to, address_contract, amount, is_pending, tx_hash)
+	_, err = stmt.Exec(address, value, version)
 	if err != nil {
 		return err
 	}
@@ -121,30 +407,293 @@ func (db *DB) InsertNotification(
 	return nil
 }
 
-func (db *DB) IsAddressKnown(address string) (bool, error) {
-	stmt, err := db.Interface.Prepare("SELECT id FROM eth_keys WHERE address = LOWER(?)")
+// RotateKeys re-encrypts every private key under the given keyring, and
+// returns the number of keys re-encrypted. Keys must be readable with one of
+// the loaded master keys, current or previous, or stored in plaintext.
+func (db *DB) RotateKeys(keyring *Keyring) (int, error) {
+	type row struct {
+		id      uint64
+		address string
+		value   string
+		version int
+	}
+
+	tx, err := db.Interface.Begin()
 	if err != nil {
-		return false, err
+		return 0, err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
+
+	// Read in the rewriting transaction: a key inserted or rotated meanwhile
+	// is not overwritten with its previous value.
+	rows, err := tx.Query("SELECT id, address, private, key_version FROM eth_keys WHERE private <> '' " + db.dialect.ForUpdate)
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]row, 0)
+
+	for rows.Next() {
+		var r row
+
+		err = rows.Scan(&r.id, &r.address, &r.value, &r.version)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		keys = append(keys, r)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		private, err := decryptKey(db.keyring, key.address, key.value, key.version)
+		if err != nil {
+			return 0, err
+		}
+
+		value, version, err := encryptKey(keyring, key.address, private)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.Exec(db.dialect.Rebind("UPDATE eth_keys SET private = ?, key_version = ? WHERE id = ?"), value, version, key.id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(keys), nil
+}
+
+// InsertNotification records a notification and returns its id, or 0 if
+// the same transfer is already recorded: there is a single notification per
+// transfer pending, and a single one mined and not orphaned since. The mined
+// notification of a transfer replaces its pending one, with a new id so
+// readers of the notifications after a cursor see it. The deliveries of a
+// recorded notification to the matching webhooks are queued along with it.
+func (db *DB) InsertNotification(msg NotifyMessage) (uint64, error) {
+	db.notificationsMu.Lock()
+	defer db.notificationsMu.Unlock()
+
+	// Out of the unique key, as NULL: the notifications of outgoing
+	// transactions and the reverted ones.
+	var current interface{}
+	if msg.MessageType == NOTIFY_TYPE_TX && msg.State != NOTIFY_STATE_REVERTED {
+		current = true
+	}
+
+	tx, err := db.Interface.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if current != nil && msg.IsPending {
+		// The pending transaction lookup may complete after the block
+		// including it was processed.
+		var id uint64
+		err = tx.QueryRow(db.dialect.Rebind(`
+			SELECT id FROM notifications
+			WHERE tx_hash = ? AND address_to = ? AND address_contract = ? AND is_pending = false AND is_current = true
+			LIMIT 1`), msg.TxHash, msg.AddressTo, msg.ContractAddress).Scan(&id)
+		if err == nil {
+			return 0, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+
+	if current != nil && false == msg.IsPending {
+		_, err = tx.Exec(db.dialect.Rebind(`
+			DELETE FROM notifications
+			WHERE tx_hash = ? AND address_to = ? AND address_contract = ? AND is_pending = true AND is_current = true`),
+			msg.TxHash, msg.AddressTo, msg.ContractAddress)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	id, err := db.insertNotification(tx, msg, current)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	msg.ID = id
+
+	err = db.enqueueDeliveries(tx, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// insertNotification inserts a notification, unless it violates the unique
+// key, and returns its id or 0.
+func (db *DB) insertNotification(ex sqlExecutor, msg NotifyMessage, current interface{}) (uint64, error) {
+	effectiveGasPrice := ""
+	if msg.EffectiveGasPrice != nil {
+		effectiveGasPrice = msg.EffectiveGasPrice.Text(10)
+	}
+
+	return db.insert(ex, `
+		INSERT INTO notifications(message_type, direction, address_from, address_to, address_contract, amount, is_pending, tx_hash,
+			log_index, block_number, block_hash, confirmations, required_confirmations, state,
+			status, gas_used, effective_gas_price, recorded_at, is_current)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) `+db.dialect.OnConflictIgnore,
+		msg.MessageType,
+		msg.Direction,
+		msg.AddressFrom,
+		msg.AddressTo,
+		msg.ContractAddress,
+		msg.Amount.Text(10),
+		msg.IsPending,
+		msg.TxHash,
+		msg.LogIndex,
+		msg.BlockNumber,
+		msg.BlockHash,
+		msg.Confirmations,
+		msg.RequiredConfirmations,
+		msg.State,
+		msg.Status,
+		msg.GasUsed,
+		effectiveGasPrice,
+		time.Now().Unix(),
+		current,
+	)
+}
+
+// DeletePendingNotifications deletes the pending notifications of a
+// transaction which was mined without being recorded, such as a failed one
+// when failed transactions are suppressed.
+func (db *DB) DeletePendingNotifications(txHash string) error {
+	_, err := db.exec(`DELETE FROM notifications WHERE tx_hash = ? AND is_pending = true AND is_current = true`, txHash)
+
+	return err
+}
+
+// UpdateConfirmations recomputes the confirmations count of every mined
+// notification against the given head, and promotes their state (see
+// ConfirmationState). A promoted notification is recorded again with a new
+// id, like a pending one once mined, so readers after a cursor see it, and
+// queued for the matching webhooks: the promoted notifications are returned.
+func (db *DB) UpdateConfirmations(head uint64) ([]NotifyMessage, error) {
+	db.notificationsMu.Lock()
+	defer db.notificationsMu.Unlock()
 
-	rows, err := stmt.Query(address)
+	tx, err := db.Interface.Begin()
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(db.dialect.Rebind(`
+		UPDATE notifications SET confirmations = ? - block_number + 1
+		WHERE message_type = ? AND state IN ('mined', 'confirmed') AND block_number <= ?`), head, NOTIFY_TYPE_TX, head)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(db.dialect.Rebind(`SELECT `+notificationColumns+` FROM notifications
+		WHERE message_type = ? AND state IN ('mined', 'confirmed') AND state <> CASE
+			WHEN confirmations >= required_confirmations THEN 'final'
+			WHEN confirmations > 1 THEN 'confirmed'
+			ELSE 'mined'
+		END
+		ORDER BY id ASC`), NOTIFY_TYPE_TX)
+	if err != nil {
+		return nil, err
+	}
+
+	promoted := make([]NotifyMessage, 0)
+
+	for rows.Next() {
+		_, msg, err := scanNotification(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		promoted = append(promoted, msg)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, msg := range promoted {
+		_, err = tx.Exec(db.dialect.Rebind("DELETE FROM notifications WHERE id = ?"), msg.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.State = ConfirmationState(msg.Confirmations, msg.RequiredConfirmations)
+
+		msg.ID, err = db.insertNotification(tx, msg, true)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.enqueueDeliveries(tx, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		promoted[i] = msg
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return promoted, nil
+}
+
+// GetAddresses returns every watched address.
+func (db *DB) GetAddresses() ([]string, error) {
+	rows, err := db.query("SELECT address FROM eth_keys")
+	if err != nil {
+		return nil, err
 	}
 	defer rows.Close()
 
-	if false == rows.Next() {
-		return false, nil
+	addresses := make([]string, 0)
+
+	for rows.Next() {
+		var address string
+
+		err = rows.Scan(&address)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = append(addresses, address)
 	}
 
-	return true, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return addresses, nil
 }
 
 func (db *DB) GetSetting(name string) (string, error) {
 	var value string
 
-	stmt, err := db.Interface.Prepare("SELECT value FROM settings WHERE name = LOWER(?)")
+	stmt, err := db.prepare("SELECT value FROM settings WHERE name = LOWER(?)")
 	if err != nil {
 		return "", err
 	}
@@ -159,30 +708,36 @@ func (db *DB) GetSetting(name string) (string, error) {
 }
 
 func (db *DB) GetKey(address string) (string, error) {
+	var storedAddress string
 	var value string
+	var version int
 
-	stmt, err := db.Interface.Prepare("SELECT private FROM eth_keys WHERE address = LOWER(?)")
+	stmt, err := db.prepare("SELECT address, private, key_version FROM eth_keys WHERE address = LOWER(?)")
 	if err != nil {
 		return "", err
 	}
 	defer stmt.Close()
 
-	err = stmt.QueryRow(address).Scan(&value)
+	err = stmt.QueryRow(address).Scan(&storedAddress, &value, &version)
+	if err == sql.ErrNoRows {
+		return "", ErrUnknownKey.Wrap(err, "Unknown address %s", address)
+	}
 	if err != nil {
 		return "", err
 	}
 
-	return value, nil
+	return decryptKey(db.keyring, storedAddress, value, version)
 }
 
 func (db *DB) SetSetting(name, value string) error {
-	stmt, err := db.Interface.Prepare(`INSERT INTO settings(name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = ?`)
+	stmt, err := db.prepare(`INSERT INTO settings(name, value) VALUES (?, ?) ` +
+		db.dialect.OnConflictUpdate([]string{"name"}, []string{"value"}))
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(name, value, value)
+	_, err = stmt.Exec(name, value)
 	if err != nil {
 		return err
 	}
@@ -190,37 +745,131 @@ func (db *DB) SetSetting(name, value string) error {
 	return nil
 }
 
-func (db *DB) GetNotifications(remove bool) ([]NotifyMessage, error) {
-	var id uint64
-
-	stmt, err := db.Interface.Prepare(
-		`SELECT id, address_from, address_to, address_contract, amount, is_pending, tx_hash
-		 FROM notifications ORDER BY id ASC LIMIT 100`)
+// SetLastBlock records the last processed block: last_block, and its hash
+// along with the ones of the keep-1 blocks before it. The hashes of the
+// blocks above it, replaced by a reorganisation, are forgotten.
+func (db *DB) SetLastBlock(number uint64, hash string, keep uint64) error {
+	tx, err := db.Interface.Begin()
 	if err != nil {
-		return []NotifyMessage{}, err
+		return err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	msgs := make([]NotifyMessage, 0)
+	_, err = tx.Exec(db.dialect.Rebind(`INSERT INTO settings(name, value) VALUES (?, ?) `+
+		db.dialect.OnConflictUpdate([]string{"name"}, []string{"value"})), "last_block", fmt.Sprintf("%d", number))
+	if err != nil {
+		return err
+	}
 
-	rows, err := stmt.Query()
-	for rows.Next() {
-		var msg NotifyMessage
-		var amount string
-
-		err := rows.Scan(
-			&id,
-			&msg.AddressFrom,
-			&msg.AddressTo,
-			&msg.ContractAddress,
-			&amount,
-			&msg.IsPending,
-			&msg.TxHash,
-		)
+	_, err = tx.Exec(db.dialect.Rebind(`INSERT INTO blocks(number, hash) VALUES (?, ?) `+
+		db.dialect.OnConflictUpdate([]string{"number"}, []string{"hash"})), number, hash)
+	if err != nil {
+		return err
+	}
+
+	var oldest uint64
+	if number >= keep {
+		oldest = number - keep + 1
+	}
+
+	_, err = tx.Exec(db.dialect.Rebind(`DELETE FROM blocks WHERE number < ? OR number > ?`), oldest, number)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetBlocks returns the hashes of the last processed blocks, by number.
+func (db *DB) GetBlocks() (map[uint64]string, error) {
+	rows, err := db.query(`SELECT number, hash FROM blocks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		msg.Amount = new(big.Int)
-		msg.Amount.SetString(amount, 10)
+	blocks := make(map[uint64]string)
 
+	for rows.Next() {
+		var number uint64
+		var hash string
+
+		err = rows.Scan(&number, &hash)
+		if err != nil {
+			return nil, err
+		}
+
+		blocks[number] = hash
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+const notificationColumns = `id, message_type, direction, address_from, address_to, address_contract, amount, is_pending, tx_hash,
+	log_index, block_number, block_hash, confirmations, required_confirmations, state,
+	status, gas_used, effective_gas_price`
+
+func scanNotification(rows *sql.Rows) (uint64, NotifyMessage, error) {
+	var id uint64
+	var msg NotifyMessage
+	var amount string
+	var effectiveGasPrice string
+
+	err := rows.Scan(
+		&id,
+		&msg.MessageType,
+		&msg.Direction,
+		&msg.AddressFrom,
+		&msg.AddressTo,
+		&msg.ContractAddress,
+		&amount,
+		&msg.IsPending,
+		&msg.TxHash,
+		&msg.LogIndex,
+		&msg.BlockNumber,
+		&msg.BlockHash,
+		&msg.Confirmations,
+		&msg.RequiredConfirmations,
+		&msg.State,
+		&msg.Status,
+		&msg.GasUsed,
+		&effectiveGasPrice,
+	)
+	if err != nil {
+		return 0, NotifyMessage{}, err
+	}
+
+	msg.ID = id
+	msg.Amount = new(big.Int)
+	msg.Amount.SetString(amount, 10)
+
+	if effectiveGasPrice != "" {
+		msg.EffectiveGasPrice = new(big.Int)
+		msg.EffectiveGasPrice.SetString(effectiveGasPrice, 10)
+	}
+
+	return id, msg, nil
+}
+
+// OrphanNotifications marks every notification mined above the given block
+// as orphaned, and returns them.
+func (db *DB) OrphanNotifications(ancestor uint64) ([]NotifyMessage, error) {
+	where := `message_type = ? AND is_pending = false AND block_number > ? AND state IN ('mined', 'confirmed', 'final')`
+
+	rows, err := db.query(`SELECT `+notificationColumns+` FROM notifications WHERE `+where+` ORDER BY id ASC`, NOTIFY_TYPE_TX, ancestor)
+	if err != nil {
+		return []NotifyMessage{}, err
+	}
+	defer rows.Close()
+
+	msgs := make([]NotifyMessage, 0)
+
+	for rows.Next() {
+		_, msg, err := scanNotification(rows)
 		if err != nil {
 			return []NotifyMessage{}, err
 		}
@@ -232,20 +881,616 @@ func (db *DB) GetNotifications(remove bool) ([]NotifyMessage, error) {
 		return []NotifyMessage{}, err
 	}
 
-	if false == remove {
-		return msgs, nil
+	_, err = db.exec(`UPDATE notifications SET state = 'orphaned', is_current = NULL WHERE `+where, NOTIFY_TYPE_TX, ancestor)
+	if err != nil {
+		return []NotifyMessage{}, err
 	}
 
-	// Remove notifications from database
-	stmt, err = db.Interface.Prepare("DELETE FROM notifications WHERE id <= ?")
+	return msgs, nil
+}
+
+// GetNotifications returns up to limit notifications recorded after the
+// given id, oldest first, optionally in the given state only.
+func (db *DB) GetNotifications(after uint64, limit int, state string) ([]NotifyMessage, error) {
+	rows, err := db.query(`SELECT `+notificationColumns+` FROM notifications
+		WHERE id > ? AND (? = '' OR state = ?) ORDER BY id ASC LIMIT ?`, after, state, state, limit)
 	if err != nil {
-		return msgs, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	_, err = stmt.Exec(id)
-	if err != nil {
-		return msgs, err
+	msgs := make([]NotifyMessage, 0)
+
+	for rows.Next() {
+		_, msg, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
 	return msgs, nil
 }
+
+// PruneNotifications deletes the notifications recorded before the given
+// unix time and acknowledged by every consumer.
+func (db *DB) PruneNotifications(before int64) (int64, error) {
+	res, err := db.exec(`
+		DELETE FROM notifications WHERE recorded_at < ?
+			AND id <= COALESCE((SELECT MIN(acked_id) FROM consumers), id)`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (db *DB) GetConsumers() ([]Consumer, error) {
+	rows, err := db.query("SELECT name, acked_id, updated_at FROM consumers ORDER BY name ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consumers := make([]Consumer, 0)
+
+	for rows.Next() {
+		var consumer Consumer
+
+		err = rows.Scan(&consumer.Name, &consumer.AckedID, &consumer.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		consumers = append(consumers, consumer)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return consumers, nil
+}
+
+// GetConsumer returns ErrNotFound (and sql.ErrNoRows) for a consumer which
+// never acknowledged anything.
+func (db *DB) GetConsumer(name string) (Consumer, error) {
+	var consumer Consumer
+
+	err := db.Interface.QueryRow(db.dialect.Rebind("SELECT name, acked_id, updated_at FROM consumers WHERE name = ?"), name).
+		Scan(&consumer.Name, &consumer.AckedID, &consumer.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return consumer, ErrNotFound.Wrap(err, "Unknown consumer %s", name)
+	}
+
+	return consumer, err
+}
+
+// AckNotifications moves the acknowledged id of a consumer forward.
+// Acknowledging an older id leaves it as is, but still marks the consumer as
+// active.
+func (db *DB) AckNotifications(name string, id uint64) (Consumer, error) {
+	now := time.Now().Unix()
+
+	_, err := db.exec("INSERT INTO consumers(name, acked_id, updated_at) VALUES(?, 0, ?) "+
+		db.dialect.OnConflictUpdate([]string{"name"}, []string{"name"}), name, now)
+	if err != nil {
+		return Consumer{}, err
+	}
+
+	// A single conditional update: concurrent acks never move the cursor
+	// backwards.
+	_, err = db.exec(`UPDATE consumers SET acked_id = CASE WHEN acked_id < ? THEN ? ELSE acked_id END, updated_at = ?
+		WHERE name = ?`, id, id, now, name)
+	if err != nil {
+		return Consumer{}, err
+	}
+
+	return db.GetConsumer(name)
+}
+
+// DeleteConsumer forgets a consumer, so it no longer holds back the pruning
+// of notifications. It returns ErrNotFound (and sql.ErrNoRows) if it does
+// not exist.
+// PruneConsumers deletes the consumers which did not acknowledge any
+// notification since before, and returns their names.
+func (db *DB) PruneConsumers(before int64) ([]string, error) {
+	rows, err := db.query("SELECT name FROM consumers WHERE updated_at < ?", before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make([]string, 0)
+
+	for rows.Next() {
+		var name string
+
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return names, nil
+	}
+
+	_, err = db.exec("DELETE FROM consumers WHERE updated_at < ?", before)
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+func (db *DB) DeleteConsumer(name string) error {
+	res, err := db.exec("DELETE FROM consumers WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrNotFound.Wrap(sql.ErrNoRows, "Unknown consumer %s", name)
+	}
+
+	return nil
+}
+
+func (db *DB) GetNonces(address string) (map[uint64]NonceReservation, error) {
+	rows, err := db.query("SELECT nonce, status, updated_at FROM nonces WHERE address = LOWER(?)", address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := make(map[uint64]NonceReservation)
+
+	for rows.Next() {
+		var reservation NonceReservation
+		var updatedAt int64
+
+		err = rows.Scan(&reservation.Nonce, &reservation.Status, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		reservation.UpdatedAt = time.Unix(updatedAt, 0)
+		reservations[reservation.Nonce] = reservation
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reservations, nil
+}
+
+func (db *DB) SetNonce(address string, nonce uint64, status string) error {
+	_, err := db.exec("INSERT INTO nonces(address, nonce, status, updated_at) VALUES(LOWER(?), ?, ?, ?) "+
+		db.dialect.OnConflictUpdate([]string{"address", "nonce"}, []string{"status", "updated_at"}),
+		address, nonce, status, time.Now().Unix())
+
+	return err
+}
+
+func (db *DB) PruneNonces(address string, below uint64) error {
+	_, err := db.exec("DELETE FROM nonces WHERE address = LOWER(?) AND nonce < ?", address, below)
+
+	return err
+}
+
+func bigIntToString(value *big.Int) string {
+	if value == nil {
+		return ""
+	}
+
+	return value.Text(10)
+}
+
+func stringToBigInt(value string) *big.Int {
+	if value == "" {
+		return nil
+	}
+
+	bgValue, ok := new(big.Int).SetString(value, 10)
+	if false == ok {
+		return nil
+	}
+
+	return bgValue
+}
+
+func (db *DB) InsertTransaction(tx OutgoingTransaction) error {
+	_, err := db.exec(`
+		INSERT INTO transactions(tx_hash, address_from, address_to, address_contract, amount, nonce, gas_limit,
+			gas_price, max_fee_per_gas, max_priority_fee_per_gas, raw_tx, status, replaces, replacements,
+			broadcast_block, updated_at)
+		VALUES(LOWER(?), LOWER(?), LOWER(?), LOWER(?), ?, ?, ?, ?, ?, ?, ?, ?, LOWER(?), ?, ?, ?)`,
+		tx.TxHash,
+		tx.AddressFrom,
+		tx.AddressTo,
+		tx.ContractAddress,
+		bigIntToString(tx.Amount),
+		tx.Nonce,
+		tx.GasLimit,
+		bigIntToString(tx.GasPrice),
+		bigIntToString(tx.MaxFeePerGas),
+		bigIntToString(tx.MaxPriorityFeePerGas),
+		tx.RawTx,
+		tx.Status,
+		tx.Replaces,
+		tx.Replacements,
+		tx.BroadcastBlock,
+		time.Now().Unix(),
+	)
+
+	return err
+}
+
+// UpdateTransaction saves the tracking state of a transaction. An empty
+// ReplacedBy never clears a replacement recorded concurrently.
+func (db *DB) UpdateTransaction(tx OutgoingTransaction) error {
+	_, err := db.exec(`
+		UPDATE transactions SET status = ?, block_number = ?, block_hash = ?, confirmations = ?,
+			gas_used = ?, effective_gas_price = ?, replaced_by = COALESCE(NULLIF(LOWER(?), ''), replaced_by),
+			broadcast_block = ?, updated_at = ?
+		WHERE tx_hash = LOWER(?)`,
+		tx.Status,
+		tx.BlockNumber,
+		tx.BlockHash,
+		tx.Confirmations,
+		tx.GasUsed,
+		bigIntToString(tx.EffectiveGasPrice),
+		tx.ReplacedBy,
+		tx.BroadcastBlock,
+		time.Now().Unix(),
+		tx.TxHash,
+	)
+
+	return err
+}
+
+const transactionColumns = `tx_hash, address_from, address_to, address_contract, amount, nonce, gas_limit,
+	gas_price, max_fee_per_gas, max_priority_fee_per_gas, raw_tx, status, block_number, block_hash,
+	confirmations, gas_used, effective_gas_price, replaces, replaced_by, replacements, broadcast_block`
+
+func scanTransaction(rows *sql.Rows) (OutgoingTransaction, error) {
+	var tx OutgoingTransaction
+	var amount, gasPrice, maxFeePerGas, maxPriorityFeePerGas, effectiveGasPrice string
+
+	err := rows.Scan(
+		&tx.TxHash,
+		&tx.AddressFrom,
+		&tx.AddressTo,
+		&tx.ContractAddress,
+		&amount,
+		&tx.Nonce,
+		&tx.GasLimit,
+		&gasPrice,
+		&maxFeePerGas,
+		&maxPriorityFeePerGas,
+		&tx.RawTx,
+		&tx.Status,
+		&tx.BlockNumber,
+		&tx.BlockHash,
+		&tx.Confirmations,
+		&tx.GasUsed,
+		&effectiveGasPrice,
+		&tx.Replaces,
+		&tx.ReplacedBy,
+		&tx.Replacements,
+		&tx.BroadcastBlock,
+	)
+	if err != nil {
+		return OutgoingTransaction{}, err
+	}
+
+	tx.Amount = stringToBigInt(amount)
+	tx.GasPrice = stringToBigInt(gasPrice)
+	tx.MaxFeePerGas = stringToBigInt(maxFeePerGas)
+	tx.MaxPriorityFeePerGas = stringToBigInt(maxPriorityFeePerGas)
+	tx.EffectiveGasPrice = stringToBigInt(effectiveGasPrice)
+
+	return tx, nil
+}
+
+func (db *DB) getTransactions(where string, args ...interface{}) ([]OutgoingTransaction, error) {
+	rows, err := db.query(`SELECT `+transactionColumns+` FROM transactions WHERE `+where+` ORDER BY id ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txs := make([]OutgoingTransaction, 0)
+
+	for rows.Next() {
+		tx, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		txs = append(txs, tx)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return txs, nil
+}
+
+func (db *DB) GetTransaction(hash string) (OutgoingTransaction, error) {
+	txs, err := db.getTransactions("tx_hash = LOWER(?)", hash)
+	if err != nil {
+		return OutgoingTransaction{}, err
+	}
+
+	if len(txs) == 0 {
+		return OutgoingTransaction{}, ErrNotFound.Wrap(sql.ErrNoRows, "Unknown transaction %s", hash)
+	}
+
+	return txs[0], nil
+}
+
+// GetTrackedTransactions returns the outgoing transactions whose status may
+// still change.
+func (db *DB) GetTrackedTransactions() ([]OutgoingTransaction, error) {
+	return db.getTransactions("status IN (?, ?)", TX_PENDING, TX_MINED)
+}
+
+func (db *DB) InsertWebhook(hook Webhook) error {
+	_, err := db.exec("INSERT INTO webhooks(id, url, address, secret) VALUES(?, ?, LOWER(?), ?)",
+		hook.ID, hook.URL, hook.Address, hook.Secret)
+
+	return err
+}
+
+// DeleteWebhook removes a webhook and its deliveries, or returns ErrNotFound
+// (and sql.ErrNoRows) if it does not exist.
+func (db *DB) DeleteWebhook(id string) error {
+	res, err := db.exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrNotFound.Wrap(sql.ErrNoRows, "Unknown webhook %s", id)
+	}
+
+	_, err = db.exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id)
+
+	return err
+}
+
+const webhookColumns = `id, url, address, secret`
+
+func (db *DB) GetWebhooks() ([]Webhook, error) {
+	rows, err := db.query("SELECT " + webhookColumns + " FROM webhooks ORDER BY created_at ASC")
+	if err != nil {
+		return nil, err
+	}
+
+	return scanWebhooks(rows)
+}
+
+// scanWebhooks reads the webhooks selected, and closes rows.
+func scanWebhooks(rows *sql.Rows) ([]Webhook, error) {
+	defer rows.Close()
+
+	hooks := make([]Webhook, 0)
+
+	for rows.Next() {
+		var hook Webhook
+
+		err := rows.Scan(&hook.ID, &hook.URL, &hook.Address, &hook.Secret)
+		if err != nil {
+			return nil, err
+		}
+
+		hooks = append(hooks, hook)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+func (db *DB) insertDelivery(ex sqlExecutor, delivery WebhookDelivery) error {
+	_, err := ex.Exec(db.dialect.Rebind(`
+		INSERT INTO webhook_deliveries(webhook_id, payload, status, attempts, next_attempt_at, last_error, updated_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?)`),
+		delivery.WebhookID,
+		delivery.Payload,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttemptAt,
+		delivery.LastError,
+		time.Now().Unix(),
+	)
+
+	return err
+}
+
+// enqueueDeliveries queues a recorded notification for every matching
+// webhook, in the transaction recording it: a notification is never
+// recorded without its deliveries.
+func (db *DB) enqueueDeliveries(tx *sql.Tx, msg NotifyMessage) error {
+	rows, err := tx.Query(db.dialect.Rebind(`SELECT ` + webhookColumns + ` FROM webhooks ORDER BY created_at ASC`))
+	if err != nil {
+		return err
+	}
+
+	hooks, err := scanWebhooks(rows)
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := NewWebhookDeliveries(hooks, msg)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		err = db.insertDelivery(tx, delivery)
+		if err != nil {
+			return fmt.Errorf("Could not queue delivery to webhook %s: %v", delivery.WebhookID, err)
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) UpdateDelivery(delivery WebhookDelivery) error {
+	_, err := db.exec(`
+		UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, updated_at = ?
+		WHERE id = ?`,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttemptAt,
+		delivery.LastError,
+		time.Now().Unix(),
+		delivery.ID,
+	)
+
+	return err
+}
+
+func (db *DB) getDeliveries(where string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := db.query(`SELECT id, webhook_id, payload, status, attempts, next_attempt_at, last_error
+		FROM webhook_deliveries WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+
+		err = rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.LastError,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// GetDueDeliveries returns the pending deliveries whose next attempt is due,
+// oldest first and up to limit per webhook, but the ones of the skipped
+// webhooks: the backlog of a webhook does not hold back the others.
+func (db *DB) GetDueDeliveries(now int64, limit int, skipped []string) ([]WebhookDelivery, error) {
+	where := "status = ? AND next_attempt_at <= ?"
+	args := []interface{}{DELIVERY_PENDING, now}
+
+	if len(skipped) > 0 {
+		where += " AND webhook_id NOT IN (?" + strings.Repeat(", ?", len(skipped)-1) + ")"
+		for _, id := range skipped {
+			args = append(args, id)
+		}
+	}
+
+	rows, err := db.query(`SELECT webhook_id FROM webhook_deliveries WHERE `+where+`
+		GROUP BY webhook_id ORDER BY MIN(id) ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+
+	for rows.Next() {
+		var id string
+
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]WebhookDelivery, 0)
+
+	for _, id := range ids {
+		due, err := db.getDeliveries("status = ? AND next_attempt_at <= ? AND webhook_id = ? ORDER BY id ASC LIMIT ?",
+			DELIVERY_PENDING, now, id, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, due...)
+	}
+
+	return deliveries, nil
+}
+
+// GetDeliveries returns the last 100 deliveries, optionally filtered by
+// webhook and status.
+func (db *DB) GetDeliveries(webhookID, status string) ([]WebhookDelivery, error) {
+	return db.getDeliveries("(? = '' OR webhook_id = ?) AND (? = '' OR status = ?) ORDER BY id DESC LIMIT 100",
+		webhookID, webhookID, status, status)
+}
+
+// ReplayDeliveries queues again the given delivery, or every dead delivery
+// of the given webhook, and returns how many were queued.
+func (db *DB) ReplayDeliveries(webhookID string, id uint64) (int64, error) {
+	res, err := db.exec(`
+		UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = ?, last_error = '', updated_at = ?
+		WHERE (? = 0 OR id = ?) AND (? = '' OR webhook_id = ?) AND (? <> 0 OR status = ?)`,
+		DELIVERY_PENDING,
+		time.Now().Unix(),
+		time.Now().Unix(),
+		id, id,
+		webhookID, webhookID,
+		id, DELIVERY_DEAD,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
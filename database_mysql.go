@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func init() {
+	RegisterDialect(&Dialect{
+		Name:       "mysql",
+		DriverName: "mysql",
+
+		DSN: func(config *Config) string {
+			return fmt.Sprintf("%s:%s@%s(%s)/%s",
+				config.DBUser,
+				config.DBPass,
+				config.DBProtocol,
+				config.DBHostname,
+				config.DBName,
+			)
+		},
+
+		OnConflictUpdate: func(conflict []string, update []string) string {
+			sets := make([]string, 0, len(update))
+			for _, column := range update {
+				sets = append(sets, fmt.Sprintf("%s = VALUES(%s)", column, column))
+			}
+
+			return "ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+		},
+		// Leaves the row unchanged, and reports no affected row.
+		OnConflictIgnore: "ON DUPLICATE KEY UPDATE id = id",
+		ForUpdate:        "FOR UPDATE",
+
+		Transient: func(err error) bool {
+			if errors.Is(err, mysql.ErrInvalidConn) {
+				return true
+			}
+
+			var mysqlErr *mysql.MySQLError
+			if false == errors.As(err, &mysqlErr) {
+				return false
+			}
+
+			switch mysqlErr.Number {
+			// Too many connections, lock wait timeout, deadlock.
+			case 1040, 1205, 1213:
+				return true
+			}
+
+			return false
+		},
+	})
+}
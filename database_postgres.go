@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/lib/pq"
+)
+
+func init() {
+	RegisterDialect(&Dialect{
+		Name:                 "postgres",
+		DriverName:           "postgres",
+		NumberedPlaceholders: true,
+		ReturningID:          true,
+
+		DSN: func(config *Config) string {
+			u := url.URL{
+				Scheme: "postgres",
+				User:   url.UserPassword(config.DBUser, config.DBPass),
+				Host:   config.DBHostname,
+				Path:   "/" + config.DBName,
+			}
+
+			if config.DBSSLMode != "" {
+				u.RawQuery = url.Values{"sslmode": {config.DBSSLMode}}.Encode()
+			}
+
+			return u.String()
+		},
+
+		OnConflictUpdate: OnConflictDoUpdate,
+		OnConflictIgnore: ON_CONFLICT_DO_NOTHING,
+		ForUpdate:        "FOR UPDATE",
+
+		Transient: func(err error) bool {
+			var pqErr *pq.Error
+			if false == errors.As(err, &pqErr) {
+				return false
+			}
+
+			switch pqErr.Code.Class() {
+			// Connection exception, transaction rollback (deadlock,
+			// serialization failure), insufficient resources, operator
+			// intervention (shutdown).
+			case "08", "40", "53", "57":
+				return true
+			}
+
+			return false
+		},
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	RegisterDialect(&Dialect{
+		Name:       "sqlite",
+		DriverName: "sqlite3",
+		// SQLite allows a single writer at a time.
+		MaxOpenConns: 1,
+
+		DSN: func(config *Config) string {
+			return fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL", config.DBName)
+		},
+
+		OnConflictUpdate: OnConflictDoUpdate,
+		OnConflictIgnore: ON_CONFLICT_DO_NOTHING,
+
+		// The database stays locked by another writer past the busy timeout.
+		Transient: func(err error) bool {
+			var sqliteErr sqlite3.Error
+			if false == errors.As(err, &sqliteErr) {
+				return false
+			}
+
+			return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+		},
+	})
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// newTestDB opens a migrated SQLite database in a temporary directory.
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+
+	dialect := dialects["sqlite"]
+
+	dbInterface, err := sql.Open(dialect.DriverName, "file:"+filepath.Join(t.TempDir(), "eth-watcher.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbInterface.SetMaxOpenConns(dialect.MaxOpenConns)
+
+	db := &DB{Interface: dbInterface, dialect: dialect}
+	t.Cleanup(db.Close)
+
+	err = MigrateUp(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestDialectRebind(t *testing.T) {
+	query := "SELECT id FROM notifications WHERE tx_hash = ? AND state IN (?, ?)"
+
+	if dialects["sqlite"].Rebind(query) != query {
+		t.Errorf("SQLite placeholders should be left as is")
+	}
+
+	if dialects["mysql"].Rebind(query) != query {
+		t.Errorf("MySQL placeholders should be left as is")
+	}
+
+	expected := "SELECT id FROM notifications WHERE tx_hash = $1 AND state IN ($2, $3)"
+	if rebound := dialects["postgres"].Rebind(query); rebound != expected {
+		t.Errorf("PostgreSQL: got %s, expected %s", rebound, expected)
+	}
+}
+
+func TestDialectOnConflict(t *testing.T) {
+	conflict := []string{"address"}
+	update := []string{"private", "key_version"}
+
+	tests := []struct {
+		dialect string
+		update  string
+		ignore  string
+	}{
+		{"sqlite", "ON CONFLICT(address) DO UPDATE SET private = excluded.private, key_version = excluded.key_version", "ON CONFLICT DO NOTHING"},
+		{"postgres", "ON CONFLICT(address) DO UPDATE SET private = excluded.private, key_version = excluded.key_version", "ON CONFLICT DO NOTHING"},
+		{"mysql", "ON DUPLICATE KEY UPDATE private = VALUES(private), key_version = VALUES(key_version)", "ON DUPLICATE KEY UPDATE id = id"},
+	}
+
+	for _, test := range tests {
+		dialect := dialects[test.dialect]
+
+		if clause := dialect.OnConflictUpdate(conflict, update); clause != test.update {
+			t.Errorf("%s: OnConflictUpdate is %s, expected %s", test.dialect, clause, test.update)
+		}
+
+		if dialect.OnConflictIgnore != test.ignore {
+			t.Errorf("%s: OnConflictIgnore is %s, expected %s", test.dialect, dialect.OnConflictIgnore, test.ignore)
+		}
+	}
+}
+
+func TestSettingsUpsert(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, value := range []string{"10", "11"} {
+		err := db.SetSetting("last_block", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, err := db.GetSetting("last_block")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != "11" {
+		t.Errorf("last_block is %s, expected 11", value)
+	}
+}
+
+func TestSetLastBlock(t *testing.T) {
+	db := newTestDB(t)
+
+	for number := uint64(1); number <= 6; number++ {
+		err := db.SetLastBlock(number, fmt.Sprintf("a%d", number), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocks, err := db.GetBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 4 || blocks[3] != "a3" || blocks[6] != "a6" {
+		t.Errorf("Expected the hashes of blocks 3 to 6, got %v", blocks)
+	}
+
+	// Block 5 replaced by a reorganisation: block 6 is forgotten.
+	err = db.SetLastBlock(5, "b5", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err = db.GetBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := blocks[6]; ok || blocks[5] != "b5" {
+		t.Errorf("Expected block 5 of the new branch last, got %v", blocks)
+	}
+
+	if value, _ := db.GetSetting("last_block"); value != "5" {
+		t.Errorf("last_block is %s, expected 5", value)
+	}
+}
+
+func TestTransient(t *testing.T) {
+	db := newTestDB(t)
+
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{errors.New("Value too long for column amount"), false},
+		{fmt.Errorf("Could not record notification: %w", driver.ErrBadConn), true},
+		{sql.ErrConnDone, true},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+	}
+
+	for _, test := range tests {
+		if db.Transient(test.err) != test.transient {
+			t.Errorf("Transient(%v) should be %v", test.err, test.transient)
+		}
+	}
+}
+
+func testNotification(pending bool) NotifyMessage {
+	msg := NotifyMessage{
+		MessageType:           NOTIFY_TYPE_TX,
+		Direction:             DIRECTION_IN,
+		AddressFrom:           "85e31428748622432ab6c13d4a3a5319f0a67186",
+		AddressTo:             "2c7536e3605d9c16a7a3d7b1898e529396a65c23",
+		Amount:                big.NewInt(1000),
+		IsPending:             pending,
+		TxHash:                "5e2b3c4d6f0e1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f70819200",
+		LogIndex:              -1,
+		RequiredConfirmations: 3,
+		State:                 NOTIFY_STATE_PENDING,
+	}
+
+	if false == pending {
+		msg.BlockNumber = 10
+		msg.BlockHash = "aa"
+		msg.Confirmations = 1
+		msg.State = NOTIFY_STATE_MINED
+		msg.Status = TX_STATUS_SUCCESS
+	}
+
+	return msg
+}
+
+func insertNotification(t *testing.T, db *DB, msg NotifyMessage) uint64 {
+	t.Helper()
+
+	id, err := db.InsertNotification(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func getNotifications(t *testing.T, db *DB, state string) []NotifyMessage {
+	t.Helper()
+
+	msgs, err := db.GetNotifications(0, 100, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msgs
+}
+
+func TestInsertNotificationPendingThenMined(t *testing.T) {
+	db := newTestDB(t)
+
+	pending := insertNotification(t, db, testNotification(true))
+	if pending == 0 {
+		t.Fatalf("Pending notification not recorded")
+	}
+
+	if id := insertNotification(t, db, testNotification(true)); id != 0 {
+		t.Errorf("Pending notification recorded twice")
+	}
+
+	mined := insertNotification(t, db, testNotification(false))
+	if mined <= pending {
+		t.Fatalf("Mined notification should replace the pending one with a new id, got %d after %d", mined, pending)
+	}
+
+	if msgs := getNotifications(t, db, NOTIFY_STATE_PENDING); len(msgs) != 0 {
+		t.Errorf("Pending notification not replaced: %+v", msgs)
+	}
+
+	if id := insertNotification(t, db, testNotification(false)); id != 0 {
+		t.Errorf("Mined notification recorded twice")
+	}
+
+	// The pending transaction lookup may complete after the block.
+	if id := insertNotification(t, db, testNotification(true)); id != 0 {
+		t.Errorf("Pending notification recorded after the mined one")
+	}
+
+	if msgs := getNotifications(t, db, ""); len(msgs) != 1 || msgs[0].ID != mined {
+		t.Errorf("Expected the mined notification only, got %+v", msgs)
+	}
+}
+
+func TestInsertNotificationKey(t *testing.T) {
+	db := newTestDB(t)
+
+	token := testNotification(true)
+	token.ContractAddress = "a3c9336a549fd2d809b34c421257d1d8b94603c8"
+	if id := insertNotification(t, db, token); id == 0 {
+		t.Fatalf("Pending token notification not recorded")
+	}
+
+	// The ETH sent along is another transfer: the pending token
+	// notification is left.
+	if id := insertNotification(t, db, testNotification(false)); id == 0 {
+		t.Fatalf("Mined notification not recorded")
+	}
+
+	if msgs := getNotifications(t, db, NOTIFY_STATE_PENDING); len(msgs) != 1 {
+		t.Fatalf("Pending token notification should be left, got %+v", msgs)
+	}
+
+	// Every Transfer log of the transaction is recorded.
+	for _, logIndex := range []int{2, 5} {
+		transfer := testNotification(false)
+		transfer.ContractAddress = token.ContractAddress
+		transfer.LogIndex = logIndex
+
+		if id := insertNotification(t, db, transfer); id == 0 {
+			t.Errorf("Transfer log %d not recorded", logIndex)
+		}
+	}
+
+	if msgs := getNotifications(t, db, NOTIFY_STATE_PENDING); len(msgs) != 0 {
+		t.Errorf("Pending token notification not replaced: %+v", msgs)
+	}
+
+	if id := insertNotification(t, db, token); id != 0 {
+		t.Errorf("Pending token notification recorded after the mined ones")
+	}
+
+	if msgs := getNotifications(t, db, ""); len(msgs) != 3 {
+		t.Errorf("Expected the 3 mined notifications, got %+v", msgs)
+	}
+}
+
+func TestDeletePendingNotifications(t *testing.T) {
+	db := newTestDB(t)
+
+	insertNotification(t, db, testNotification(true))
+
+	err := db.DeletePendingNotifications(testNotification(true).TxHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs := getNotifications(t, db, ""); len(msgs) != 0 {
+		t.Errorf("Pending notification not deleted: %+v", msgs)
+	}
+}
+
+func TestUpdateConfirmations(t *testing.T) {
+	db := newTestDB(t)
+
+	mined := insertNotification(t, db, testNotification(false))
+
+	tests := []struct {
+		head     uint64
+		promoted string
+	}{
+		{10, ""},
+		{11, NOTIFY_STATE_CONFIRMED},
+		{12, NOTIFY_STATE_FINAL},
+		{13, ""},
+	}
+
+	last := mined
+
+	for _, test := range tests {
+		promoted, err := db.UpdateConfirmations(test.head)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.promoted == "" {
+			if len(promoted) != 0 {
+				t.Errorf("Head %d: nothing should be promoted, got %+v", test.head, promoted)
+			}
+			continue
+		}
+
+		if len(promoted) != 1 || promoted[0].State != test.promoted {
+			t.Fatalf("Head %d: expected a %s notification, got %+v", test.head, test.promoted, promoted)
+		}
+
+		if promoted[0].ID <= last {
+			t.Errorf("Head %d: promoted notification should get a new id, got %d after %d", test.head, promoted[0].ID, last)
+		}
+		last = promoted[0].ID
+
+		msgs := getNotifications(t, db, "")
+		if len(msgs) != 1 || msgs[0].ID != last || msgs[0].Confirmations != test.head-9 {
+			t.Errorf("Head %d: expected the promoted notification only, got %+v", test.head, msgs)
+		}
+	}
+}
+
+func TestKeysRoundTrip(t *testing.T) {
+	db := newTestDB(t)
+	address := "2C7536E3605D9C16A7A3D7B1898E529396A65C23"
+
+	err := db.InsertKey(address, TEST_PRIVATE_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are stored in plaintext without a master key.
+	private, err := db.GetKey(address)
+	if err != nil || private != TEST_PRIVATE_KEY {
+		t.Fatalf("GetKey returned %q, %v", private, err)
+	}
+
+	_, err = db.GetKey("85e31428748622432ab6c13d4a3a5319f0a67186")
+	if GetAPIError(err) != ErrUnknownKey {
+		t.Errorf("Unknown address should fail with %s, got %v", ErrUnknownKey.Code, err)
+	}
+
+	keyring := newTestKeyring(t, 1, TEST_MASTER_KEY)
+
+	count, err := db.RotateKeys(keyring)
+	if err != nil || count != 1 {
+		t.Fatalf("RotateKeys returned %d, %v", count, err)
+	}
+
+	db.keyring = keyring
+
+	var stored string
+	err = db.Interface.QueryRow("SELECT private FROM eth_keys").Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored == TEST_PRIVATE_KEY {
+		t.Errorf("Private key still stored in plaintext after rotation")
+	}
+
+	private, err = db.GetKey(address)
+	if err != nil || private != TEST_PRIVATE_KEY {
+		t.Fatalf("GetKey returned %q, %v after rotation", private, err)
+	}
+
+	// Rotation to version 2, the previous master key still loaded.
+	next := newTestKeyring(t, 2, strings.Repeat("ff", 32))
+
+	count, err = db.RotateKeys(next)
+	if err != nil || count != 1 {
+		t.Fatalf("RotateKeys returned %d, %v", count, err)
+	}
+
+	db.keyring = next
+
+	private, err = db.GetKey(address)
+	if err != nil || private != TEST_PRIVATE_KEY {
+		t.Fatalf("GetKey returned %q, %v after the second rotation", private, err)
+	}
+
+	db.keyring = keyring
+
+	_, err = db.GetKey(address)
+	if err == nil {
+		t.Errorf("Key encrypted with master key version 2 should not be readable with version 1 only")
+	}
+}
+
+func TestInsertNotificationQueuesDeliveries(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, hook := range []Webhook{
+		{ID: "all", URL: "http://localhost/all", Secret: "secret"},
+		{ID: "other", URL: "http://localhost/other", Address: "a3c9336a549fd2d809b34c421257d1d8b94603c8", Secret: "secret"},
+	} {
+		err := db.InsertWebhook(hook)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insertNotification(t, db, testNotification(false))
+
+	// Already recorded: not queued again.
+	insertNotification(t, db, testNotification(false))
+
+	deliveries, err := db.GetDeliveries("", DELIVERY_PENDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 1 || deliveries[0].WebhookID != "all" {
+		t.Fatalf("Expected a single delivery to the matching webhook, got %+v", deliveries)
+	}
+
+	// Promotions are queued along with them.
+	_, err = db.UpdateConfirmations(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries, err = db.GetDeliveries("all", DELIVERY_PENDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 2 {
+		t.Errorf("Expected the delivery of the confirmed notification, got %+v", deliveries)
+	}
+}
+
+func TestGetDueDeliveriesPerWebhook(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, hook := range []string{"busy", "quiet"} {
+		err := db.InsertWebhook(Webhook{ID: hook, URL: "http://localhost/" + hook, Secret: "secret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The backlog of the first webhook is older than the delivery of the
+	// second one.
+	for i := 0; i < 5; i++ {
+		err := db.insertDelivery(db.Interface, WebhookDelivery{WebhookID: "busy", Payload: "{}", Status: DELIVERY_PENDING})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := db.insertDelivery(db.Interface, WebhookDelivery{WebhookID: "quiet", Payload: "{}", Status: DELIVERY_PENDING})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries, err := db.GetDueDeliveries(0, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := map[string]int{}
+	for _, delivery := range deliveries {
+		count[delivery.WebhookID]++
+	}
+
+	if count["busy"] != 2 || count["quiet"] != 1 {
+		t.Errorf("Expected 2 deliveries to busy and 1 to quiet, got %v", count)
+	}
+
+	deliveries, err = db.GetDueDeliveries(0, 2, []string{"busy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 1 || deliveries[0].WebhookID != "quiet" {
+		t.Errorf("Skipped webhook deliveries returned: %+v", deliveries)
+	}
+}
+
+func TestAckNotifications(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, id := range []uint64{5, 3, 8, 7} {
+		_, err := db.AckNotifications("accounting", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	consumer, err := db.GetConsumer("accounting")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if consumer.AckedID != 8 {
+		t.Errorf("Acknowledged id is %d, expected 8: never moved backwards", consumer.AckedID)
+	}
+}
+
+func TestPruneConsumers(t *testing.T) {
+	db := newTestDB(t)
+
+	_, err := db.AckNotifications("abandoned", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Interface.Exec("UPDATE consumers SET updated_at = 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AckNotifications("active", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := db.PruneConsumers(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 1 || names[0] != "abandoned" {
+		t.Errorf("Expected the abandoned consumer pruned, got %v", names)
+	}
+
+	consumers, err := db.GetConsumers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(consumers) != 1 || consumers[0].Name != "active" {
+		t.Errorf("Expected the active consumer left, got %+v", consumers)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// APIError is a kind of error, with the stable code and the HTTP status the
+// API responds with.
+type APIError struct {
+	Code   string
+	Status int
+}
+
+func (e *APIError) Error() string {
+	return e.Code
+}
+
+var (
+	ErrInvalidRequest         = &APIError{"invalid_request", 400}
+	ErrInvalidAddress         = &APIError{"invalid_address", 400}
+	ErrNotFound               = &APIError{"not_found", 404}
+	ErrConflict               = &APIError{"conflict", 409}
+	ErrUnknownKey             = &APIError{"unknown_key", 422}
+	ErrInsufficientFunds      = &APIError{"insufficient_funds", 422}
+	ErrNonceTooLow            = &APIError{"nonce_too_low", 409}
+	ErrReplacementUnderpriced = &APIError{"replacement_underpriced", 409}
+	ErrTransactionRejected    = &APIError{"transaction_rejected", 422}
+	ErrNodeError              = &APIError{"node_error", 502}
+	ErrNodeUnavailable        = &APIError{"node_unavailable", 503}
+	ErrNodeTimeout            = &APIError{"node_timeout", 504}
+	ErrRequestCanceled        = &APIError{"request_canceled", 499}
+	ErrInternal               = &APIError{"internal_error", 500}
+)
+
+// apiError is an error message of a given kind, optionally caused by
+// another error.
+type apiError struct {
+	kind  *APIError
+	msg   string
+	cause error
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+func (e *apiError) Unwrap() error {
+	return e.kind
+}
+
+func (e *apiError) Is(target error) bool {
+	return e.cause != nil && errors.Is(e.cause, target)
+}
+
+// Errorf returns an error of this kind.
+func (e *APIError) Errorf(format string, args ...interface{}) error {
+	return &apiError{e, fmt.Sprintf(format, args...), nil}
+}
+
+// Wrap returns an error of this kind caused by err: errors.Is matches both.
+func (e *APIError) Wrap(err error, format string, args ...interface{}) error {
+	return &apiError{e, fmt.Sprintf(format, args...), err}
+}
+
+// GetAPIError returns the kind of an error, ErrInternal if it has none.
+func GetAPIError(err error) *APIError {
+	kind := ErrInternal
+	errors.As(err, &kind)
+
+	return kind
+}
+
+// NodeError gives its kind to an error returned by the node.
+func NodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	switch {
+	case strings.Contains(msg, "insufficient funds"):
+		return ErrInsufficientFunds.Wrap(err, "%v", err)
+	case strings.Contains(msg, "nonce too low"):
+		return ErrNonceTooLow.Wrap(err, "%v", err)
+	case strings.Contains(msg, "replacement transaction underpriced"):
+		return ErrReplacementUnderpriced.Wrap(err, "%v", err)
+	case strings.Contains(msg, "underpriced"), strings.Contains(msg, "execution reverted"), strings.Contains(msg, "gas required exceeds"),
+		strings.Contains(msg, "intrinsic gas too low"), strings.Contains(msg, "exceeds block gas limit"):
+		return ErrTransactionRejected.Wrap(err, "%v", err)
+	case errors.Is(err, bind.ErrNoCode):
+		return ErrInvalidAddress.Wrap(err, "%v", err)
+	case errors.Is(err, ethereum.NotFound):
+		return ErrNotFound.Wrap(err, "%v", err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrNodeTimeout.Wrap(err, "%v", err)
+	case errors.Is(err, context.Canceled):
+		// The client went away: not a failure of the node.
+		return ErrRequestCanceled.Wrap(err, "%v", err)
+	}
+
+	// The node answered, with an error.
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) {
+		return ErrNodeError.Wrap(err, "%v", err)
+	}
+
+	return ErrNodeUnavailable.Wrap(err, "%v", err)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"math/big"
 	"net/http"
@@ -14,26 +15,103 @@ const (
 	NOTIFY_TYPE_NONE = iota
 	NOTIFY_TYPE_TX
 	NOTIFY_TYPE_ADMIN
+	NOTIFY_TYPE_REORG
+	NOTIFY_TYPE_OUTGOING
+)
+
+const (
+	NOTIFY_STATE_PENDING   = "pending"
+	NOTIFY_STATE_MINED     = "mined"
+	NOTIFY_STATE_CONFIRMED = "confirmed"
+	NOTIFY_STATE_FINAL     = "final"
+	NOTIFY_STATE_ORPHANED  = "orphaned"
+	NOTIFY_STATE_REVERTED  = "reverted"
+	NOTIFY_STATE_FAILED    = "failed"
+	NOTIFY_STATE_DROPPED   = "dropped"
+	NOTIFY_STATE_REPLACED  = "replaced"
+)
+
+// Direction of a notification, relative to the watched addresses.
+const (
+	DIRECTION_IN       = "in"
+	DIRECTION_OUT      = "out"
+	DIRECTION_INTERNAL = "internal"
+)
+
+const (
+	TX_STATUS_SUCCESS = "success"
+	TX_STATUS_FAILED  = "failed"
 )
 
 type NotifyMessage struct {
-	MessageType     int
-	AddressFrom     string
-	AddressTo       string
-	Amount          *big.Int
-	ContractAddress string
-	IsPending       bool
-	TxHash          string
+	// Set once recorded; streams and webhooks consumers use it as a cursor.
+	ID                    uint64
+	MessageType           int
+	Direction             string
+	AddressFrom           string
+	AddressTo             string
+	Amount                *big.Int
+	ContractAddress       string
+	IsPending             bool
+	TxHash                string
+	LogIndex              int
+	BlockNumber           uint64
+	BlockHash             string
+	Confirmations         uint64
+	RequiredConfirmations uint64
+	State                 string
+	Status                string
+	GasUsed               uint64
+	EffectiveGasPrice     *big.Int
+}
+
+// GetDirection tells whether a transfer between the given addresses enters,
+// leaves or stays within the watched addresses.
+func GetDirection(fromKnown, toKnown bool) string {
+	switch {
+	case fromKnown && toKnown:
+		return DIRECTION_INTERNAL
+	case fromKnown:
+		return DIRECTION_OUT
+	}
+
+	return DIRECTION_IN
+}
+
+// ConfirmationState returns the state of a mined notification with the given
+// confirmations.
+func ConfirmationState(confirmations, required uint64) string {
+	switch {
+	case confirmations >= required:
+		return NOTIFY_STATE_FINAL
+	case confirmations > 1:
+		return NOTIFY_STATE_CONFIRMED
+	}
+
+	return NOTIFY_STATE_MINED
+}
+
+func IsDirection(direction string) bool {
+	return direction == DIRECTION_IN || direction == DIRECTION_OUT || direction == DIRECTION_INTERNAL
+}
+
+func IsNotifyState(state string) bool {
+	switch state {
+	case NOTIFY_STATE_PENDING, NOTIFY_STATE_MINED, NOTIFY_STATE_CONFIRMED, NOTIFY_STATE_FINAL,
+		NOTIFY_STATE_ORPHANED, NOTIFY_STATE_REVERTED, NOTIFY_STATE_FAILED, NOTIFY_STATE_DROPPED,
+		NOTIFY_STATE_REPLACED:
+		return true
+	}
+
+	return false
 }
 
 var (
 	fDebug      bool
-	fInit       bool
 	fConfigFile string
 )
 
 func init() {
-	flag.BoolVar(&fInit, "init", false, "DB Init")
 	flag.BoolVar(&fDebug, "debug", false, "Debug")
 	flag.StringVar(&fConfigFile, "config", "config.ini", "Configuration file")
 }
@@ -54,16 +132,45 @@ func main() {
 	}
 	defer db.Close()
 
-	if fInit {
-		err = db.InitTables()
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "migrate":
+			err = MigrateCommand(db, flag.Args()[1:])
+		case "rescan":
+			err = CheckSchema(db)
+			if err == nil {
+				var nodes *NodePool
+				nodes, err = OpenNodePool(config)
+				if err == nil {
+					err = RescanCommand(config, db, nodes, flag.Args()[1:])
+				}
+			}
+		case "rotate-keys":
+			err = CheckSchema(db)
+			if err == nil {
+				err = RotateKeysCommand(config, db, flag.Args()[1:])
+			}
+		default:
+			err = fmt.Errorf("Unknown command '%s'", flag.Arg(0))
+		}
+
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
-		log.Println("Schema created in database.")
 
 		return
 	}
 
+	err = CheckSchema(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	nodes, err := OpenNodePool(config)
+	if err != nil {
+		panic(err)
+	}
+
 	last_id_str, err := db.GetSetting("last_block")
 	if err != nil {
 		log.Println("Warning: Could not get last block id parsed from database: No recovery.")
@@ -76,20 +183,62 @@ func main() {
 		}
 	}
 
+	// A reorganisation of the chain while stopped is detected against the
+	// blocks processed before.
+	window, err := LoadBlockWindow(db)
+	if err != nil {
+		log.Printf("Warning: Could not load the last processed blocks: %v: A reorg while stopped is not detected", err)
+		window = NewBlockWindow(BLOCK_WINDOW_SIZE)
+	}
+
+	nonces := NewNonceManager(db)
+
+	addresses := NewAddressSet()
+	err = addresses.Load(db)
+	if err != nil {
+		log.Fatalf("Could not load watched addresses: %v", err)
+	}
+
+	log.Printf("Watching %d addresses", addresses.Len())
+
+	rescanner := NewRescanner(nodes)
+
 	r := mux.NewRouter()
-	r.HandleFunc("/createAddress", CreateAddressHandler(config, db)).Methods("POST")
-	r.HandleFunc("/registerAddress", RegisterAddressHandler(config, db)).Methods("POST")
-	r.HandleFunc("/getBalance", GetBalanceHandler(config))
-	r.HandleFunc("/sendEth", SendEthHandler(config))
-	r.HandleFunc("/sendErc20", SendERC20Handler(config, db))
+	r.HandleFunc("/createAddress", CreateAddressHandler(config, db, addresses)).Methods("POST")
+	r.HandleFunc("/registerAddress", RegisterAddressHandler(config, db, addresses)).Methods("POST")
+	r.HandleFunc("/getBalance", GetBalanceHandler(config, nodes))
+	r.HandleFunc("/sendEth", SendEthHandler(config, db, nodes, nonces))
+	r.HandleFunc("/sendErc20", SendERC20Handler(config, db, nodes, nonces))
+	r.HandleFunc("/speedUpTransaction", ReplaceTransactionHandler(config, db, nodes, false))
+	r.HandleFunc("/cancelTransaction", ReplaceTransactionHandler(config, db, nodes, true))
 	r.HandleFunc("/getNotifications", GetNotificationsHandler(config, db))
+	r.HandleFunc("/ackNotifications", AckNotificationsHandler(config, db)).Methods("POST")
+	r.HandleFunc("/getConsumers", GetConsumersHandler(config, db))
+	r.HandleFunc("/removeConsumer", RemoveConsumerHandler(config, db)).Methods("POST")
+	r.HandleFunc("/getTransaction", GetTransactionHandler(config, db))
+	r.HandleFunc("/rescan", RescanHandler(config, db, addresses, rescanner)).Methods("POST")
+	r.HandleFunc("/getRescan", GetRescanHandler(config, rescanner))
+	r.HandleFunc("/getNodes", GetNodesHandler(config, nodes))
+	r.HandleFunc("/ws/notifications", WebsocketNotificationsHandler(config, db))
+	r.HandleFunc("/events", EventsHandler(config, db))
+	r.HandleFunc("/registerWebhook", RegisterWebhookHandler(config, db)).Methods("POST")
+	r.HandleFunc("/removeWebhook", RemoveWebhookHandler(config, db)).Methods("POST")
+	r.HandleFunc("/getWebhooks", GetWebhooksHandler(config, db))
+	r.HandleFunc("/getWebhookDeliveries", GetWebhookDeliveriesHandler(config, db))
+	r.HandleFunc("/replayWebhookDeliveries", ReplayWebhookDeliveriesHandler(config, db)).Methods("POST")
 
 	r.NotFoundHandler = http.HandlerFunc(NotFoundHandler)
 
 	ch := make(chan NotifyMessage, 1024)
-
-	go Notifier(config, db, ch)
-	go Subscriber(config, ch, last_id)
+	heads := make(chan uint64, 16)
+
+	go NodeHealthChecker(config, nodes)
+	go Notifier(config, db, addresses, ch, heads)
+	go AddressRefresher(config, db, addresses)
+	go Tracker(config, db, nodes, nonces, heads)
+	go WebhookDispatcher(config, db)
+	go NotificationJanitor(config, db)
+	go Subscriber(config, nodes, ch, last_id, window)
 
 	log.Println("Starting webserver...")
 	http.ListenAndServe(":8080", r)
@@ -6,18 +6,22 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
+	"strings"
 
 	"github.com/btcsuite/btcd/btcec"
-	"github.com/ethereum/go-ethereum/crypto/sha3"
 
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 )
 
 func GenerateKey() (*ecdsa.PrivateKey, error) {
@@ -25,11 +29,7 @@ func GenerateKey() (*ecdsa.PrivateKey, error) {
 }
 
 func Keccak256(in []byte) []byte {
-	hash := sha3.NewKeccak256()
-
-	hash.Write(in)
-
-	return hash.Sum(nil)
+	return crypto.Keccak256(in)
 }
 
 func Prepend(in []byte, size int) []byte {
@@ -101,146 +101,226 @@ func IsAddress(address string) bool {
 	return common.IsHexAddress(address)
 }
 
-func ConnectRPC(config *Config) (*ethclient.Client, error) {
-	client, err := ethclient.Dial(fmt.Sprintf("http://%s", config.RPCURL))
+// GetAddressBalance returns the ETH balance of an address, in wei.
+func GetAddressBalance(ctx context.Context, client *ethclient.Client, address string) (*big.Int, error) {
+	balance, err := client.BalanceAt(ctx, common.HexToAddress(address), nil)
 	if err != nil {
-		return nil, fmt.Errorf("Could not connect to Ethereum RPC API: %v", err)
+		return nil, fmt.Errorf("Could not retrieve balance: %w", NodeError(err))
 	}
 
-	return client, nil
+	return balance, nil
 }
 
-func GetAddressBalance(config *Config, address string) (*big.Float, error) {
-	var context = context.Background()
+func GetERC20AddressBalance(ctx context.Context, client *ethclient.Client, address string, contractAddress string) (*big.Int, error) {
+	token, err := NewToken(common.HexToAddress(contractAddress), client)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to instantiate a Token contract: %v", err)
+	}
 
-	client, err := ConnectRPC(config)
+	balance, err := token.BalanceOf(&bind.CallOpts{Context: ctx}, common.HexToAddress(address))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Failed to retrieve balance for token: %w", NodeError(err))
 	}
-	defer client.Close()
 
-	bgInt, err := client.BalanceAt(context, common.HexToAddress(address), nil)
+	return balance, nil
+}
 
-	bgWei := new(big.Float)
-	bgWei.UnmarshalText([]byte("0.000000000000000001"))
+// GetERC20Decimals returns the decimals of a token. It is optional in the
+// ERC20 standard: tokens without it are considered to have none.
+func GetERC20Decimals(ctx context.Context, client *ethclient.Client, contractAddress string) (uint8, error) {
+	contract := common.HexToAddress(contractAddress)
 
-	bgFloat := new(big.Float)
-	bgFloat.SetInt(bgInt)
-	bgFloat = bgFloat.Mul(bgWei, bgFloat)
+	token, err := NewToken(contract, client)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to instantiate a Token contract: %v", err)
+	}
 
-	return bgFloat, nil
-}
+	decimals, err := token.Decimals(&bind.CallOpts{Context: ctx})
+	if err == nil {
+		return decimals, nil
+	}
 
-func GetERC20AddressBalance(config *Config, address string, contractAddress string) (*big.Int, error) {
-	client, err := ConnectRPC(config)
-	if err != nil {
-		return nil, err
+	// decimals() is optional: a token contract without it has none. Any
+	// other failure (no contract, unexpected answer, node error) could
+	// make amounts off by orders of magnitude.
+	if false == IsExecutionReverted(err) {
+		return 0, fmt.Errorf("Failed to retrieve decimals of token: %w", NodeError(err))
 	}
-	defer client.Close()
 
-	token, err := NewToken(common.HexToAddress(contractAddress), client)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to instantiate a Token contract: %v", err)
+	code, codeErr := client.CodeAt(ctx, contract, nil)
+	if codeErr != nil {
+		return 0, fmt.Errorf("Failed to retrieve decimals of token: %w", NodeError(codeErr))
 	}
 
-	balance, err := token.BalanceOf(nil, common.HexToAddress(address))
-	if err != nil {
-		return nil, fmt.Errorf("Failed to retrieve balance for token: %v", err)
+	if len(code) == 0 {
+		return 0, ErrInvalidAddress.Errorf("Failed to retrieve decimals of token: %s is not a contract", contractAddress)
 	}
 
-	return balance, nil
+	log.Printf("Token %s has no decimals, using 0: %v", contractAddress, err)
+
+	return 0, nil
 }
 
-func SendEthCoin(config *Config, amount *big.Int, private string, address string) (string, error) {
-	ctx := context.Background()
-	signer := types.HomesteadSigner{}
+// JSON-RPC error code of a call which reverted.
+const RPC_CODE_EXECUTION_REVERTED = 3
 
-	client, err := ConnectRPC(config)
-	if err != nil {
-		return "", err
+// IsExecutionReverted returns whether a contract call failed because the
+// contract reverted, rather than because of the node: it then answers with
+// the revert error code, or with the revert data.
+func IsExecutionReverted(err error) bool {
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == RPC_CODE_EXECUTION_REVERTED {
+		return true
 	}
-	defer client.Close()
 
+	var dataErr rpc.DataError
+
+	return errors.As(err, &dataErr)
+}
+
+func SendEthCoin(ctx context.Context, config *Config, client *ethclient.Client, nonces *NonceManager, amount *big.Int, private string, address string, opts TxOptions) (*types.Transaction, error) {
 	key, err := crypto.HexToECDSA(private)
 	if err != nil {
-		return "", err
+		return nil, ErrInvalidRequest.Errorf("Invalid private key: %v", err)
 	}
 
-	nonce, err := client.NonceAt(ctx, crypto.PubkeyToAddress(key.PublicKey), nil)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	to := common.HexToAddress(address)
+
+	chainID, err := GetChainID(ctx, config, client)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	tx := types.NewTransaction(
-		nonce,
-		common.HexToAddress(address),
-		amount,       // amount
-		60000,        // gasLimit
-		new(big.Int), // gasPrice
-		[]byte(""),
-	)
+	fees, err := SuggestFees(ctx, client, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	signature, err := crypto.Sign(signer.Hash(tx).Bytes(), key)
+	gasLimit := opts.GasLimit
+	if gasLimit == 0 {
+		gasLimit, err = client.EstimateGas(ctx, ethereum.CallMsg{From: from, To: &to, Value: amount})
+		if err != nil {
+			return nil, fmt.Errorf("Could not estimate gas: %w", NodeError(err))
+		}
+	}
+
+	nonce, err := nonces.Allocate(ctx, client, from)
 	if err != nil {
-		return "", fmt.Errorf("Signature creation error: %v", err)
+		return nil, err
 	}
 
-	signedTx, err := tx.WithSignature(signer, signature)
+	tx := NewTransaction(chainID, nonce, to, amount, gasLimit, fees, nil)
+
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(chainID), key)
 	if err != nil {
-		return "", fmt.Errorf("Signer with signature error: %v", err)
+		nonces.Release(from, nonce)
+		return nil, fmt.Errorf("Signature creation error: %v", err)
 	}
 
-	err = client.SendTransaction(context.Background(), signedTx)
+	err = BroadcastTransaction(config, client, signedTx)
 	if err != nil {
-		return "", fmt.Errorf("Send tx error: %v", err)
+		if BroadcastRejected(err) {
+			nonces.Release(from, nonce)
+		}
+		return nil, fmt.Errorf("Send tx error: %w", NodeError(err))
 	}
 
-	return signedTx.Hash().String(), nil
+	nonces.Confirm(from, nonce)
+
+	return signedTx, nil
 }
 
-func SendERC20Token(config *Config, amount *big.Int, contractAddress, private, address string) (string, error) {
-	client, err := ConnectRPC(config)
-	if err != nil {
-		return "", err
-	}
-	defer client.Close()
+// BroadcastTransaction sends a signed transaction to the node. The broadcast
+// is bounded by the RPC timeout but not by the request: once the transaction
+// is signed and its nonce reserved, a client going away must not leave it
+// half sent.
+func BroadcastTransaction(config *Config, client *ethclient.Client, tx *types.Transaction) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.RPCTimeout)
+	defer cancel()
+
+	return client.SendTransaction(ctx, tx)
+}
+
+// BroadcastRejected returns whether a broadcast failed because the node
+// rejected the transaction. After a timeout or a transport error, the
+// transaction may have reached the node anyway: its nonce is then kept
+// reserved, until mined or reclaimed (see NONCE_RESERVATION_TIMEOUT).
+func BroadcastRejected(err error) bool {
+	var rpcErr rpc.Error
+
+	return errors.As(err, &rpcErr)
+}
 
+func SendERC20Token(ctx context.Context, config *Config, client *ethclient.Client, nonces *NonceManager, amount *big.Int, contractAddress, private, address string, opts TxOptions) (*types.Transaction, error) {
 	token, err := NewToken(common.HexToAddress(contractAddress), client)
 	if err != nil {
-		return "", fmt.Errorf("Failed to instantiate a Token contract: %v", err)
+		return nil, fmt.Errorf("Failed to instantiate a Token contract: %v", err)
 	}
 
 	key, err := crypto.HexToECDSA(private)
 	if err != nil {
-		return "", err
+		return nil, ErrInvalidRequest.Errorf("Invalid private key: %v", err)
 	}
 
-	auth := bind.NewKeyedTransactor(key)
+	chainID, err := GetChainID(ctx, config, client)
+	if err != nil {
+		return nil, err
+	}
 
-	tx, err := token.Transfer(auth, common.HexToAddress(address), amount)
+	fees, err := SuggestFees(ctx, client, opts)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return tx.Hash().String(), nil
-}
+	auth, err := bind.NewKeyedTransactorWithChainID(key, chainID)
+	if err != nil {
+		return nil, err
+	}
 
-func GetTransactionFrom(tx *types.Transaction) (common.Address, error) {
-	var signer types.Signer
-	signer = types.HomesteadSigner{}
+	// The transaction is only signed here, see BroadcastTransaction.
+	auth.Context = ctx
+	auth.NoSend = true
+	auth.GasLimit = opts.GasLimit
 
-	v, _, _ := tx.RawSignatureValues()
+	if fees.Legacy {
+		auth.GasPrice = fees.GasPrice
+	} else {
+		auth.GasFeeCap = fees.GasFeeCap
+		auth.GasTipCap = fees.GasTipCap
+	}
 
-	if v.Sign() != 0 && tx.Protected() {
-		signer = types.NewEIP155Signer(tx.ChainId())
+	nonce, err := nonces.Allocate(ctx, client, auth.From)
+	if err != nil {
+		return nil, err
 	}
 
-	msg, err := tx.AsMessage(signer)
+	auth.Nonce = new(big.Int).SetUint64(nonce)
+
+	tx, err := token.Transfer(auth, common.HexToAddress(address), amount)
 	if err != nil {
-		return common.Address{}, err
+		nonces.Release(auth.From, nonce)
+		return nil, NodeError(err)
 	}
 
-	return msg.From(), nil
+	err = BroadcastTransaction(config, client, tx)
+	if err != nil {
+		if BroadcastRejected(err) {
+			nonces.Release(auth.From, nonce)
+		}
+		return nil, fmt.Errorf("Send tx error: %w", NodeError(err))
+	}
+
+	nonces.Confirm(auth.From, nonce)
+
+	return tx, nil
+}
+
+func GetTransactionFrom(tx *types.Transaction) (common.Address, error) {
+	// Unprotected legacy transactions are recovered as homestead ones.
+	signer := types.LatestSignerForChainID(tx.ChainId())
+
+	return types.Sender(signer, tx)
 }
 
 func GetContractDestAddress(data []byte) (common.Address, *big.Int, error) {
@@ -311,6 +391,11 @@ func ParseTransaction(tx *types.Transaction, isPending bool) (NotifyMessage, err
 		return NotifyMessage{}, err
 	}
 
+	state := NOTIFY_STATE_MINED
+	if isPending {
+		state = NOTIFY_STATE_PENDING
+	}
+
 	dest, value, err := GetContractDestAddress(tx.Data())
 	if err != nil {
 		dest = *tx.To()
@@ -328,6 +413,8 @@ func ParseTransaction(tx *types.Transaction, isPending bool) (NotifyMessage, err
 			ContractAddress: "",
 			IsPending:       isPending,
 			TxHash:          tx.Hash().Hex()[2:],
+			LogIndex:        -1,
+			State:           state,
 		}, nil
 	} else {
 		contractDest = *tx.To()
@@ -344,24 +431,194 @@ func ParseTransaction(tx *types.Transaction, isPending bool) (NotifyMessage, err
 			ContractAddress: contractDest.Hex()[2:],
 			IsPending:       isPending,
 			TxHash:          tx.Hash().Hex()[2:],
+			LogIndex:        -1,
+			State:           state,
 		}, nil
 	}
 
 	return NotifyMessage{}, nil
 }
 
-func ReadTransaction(client *ethclient.Client, hashStr string) (NotifyMessage, error) {
+func ReadTransaction(ctx context.Context, client *ethclient.Client, hashStr string) (NotifyMessage, error) {
 	hash := common.HexToHash(hashStr)
 
-	tx, pending, err := client.TransactionByHash(context.Background(), hash)
+	tx, pending, err := client.TransactionByHash(ctx, hash)
 	if err != nil {
-		return NotifyMessage{}, fmt.Errorf("ReadTransaction(%s) failed: %v", hash.Hex(), err)
+		return NotifyMessage{}, fmt.Errorf("ReadTransaction(%s) failed: %w", hash.Hex(), NodeError(err))
 	}
 
 	return ParseTransaction(tx, pending)
 }
 
-func ReadBlock(client *ethclient.Client, hashStr string, number *big.Int) (*big.Int, []NotifyMessage, error) {
+// Topic of the erc20 Transfer(address,address,uint256) event.
+var transferEventTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
+// ABI of the erc20 tokens, parsed once for every Transfer log, and the
+// indexed arguments of the Transfer event, read from the log topics.
+var (
+	tokenABI              = mustParseABI(TokenABI)
+	transferIndexedInputs = indexedInputs(tokenABI.Events["Transfer"].Inputs)
+)
+
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(fmt.Sprintf("Invalid ABI: %v", err))
+	}
+
+	return parsed
+}
+
+func indexedInputs(inputs abi.Arguments) abi.Arguments {
+	indexed := make(abi.Arguments, 0)
+	for _, input := range inputs {
+		if input.Indexed {
+			indexed = append(indexed, input)
+		}
+	}
+
+	return indexed
+}
+
+func ParseTransferLog(vLog types.Log) (NotifyMessage, error) {
+	// erc721 shares the Transfer signature but indexes the token id.
+	if len(vLog.Topics) != 3 || len(vLog.Data) != 32 {
+		return NotifyMessage{}, nil
+	}
+
+	event := new(TokenTransfer)
+
+	err := tokenABI.UnpackIntoInterface(event, "Transfer", vLog.Data)
+	if err == nil {
+		err = abi.ParseTopics(event, transferIndexedInputs, vLog.Topics[1:])
+	}
+	if err != nil {
+		return NotifyMessage{}, fmt.Errorf("Could not unpack Transfer log %s/%d: %v", vLog.TxHash.Hex(), vLog.Index, err)
+	}
+
+	if fDebug {
+		log.Printf("Log(%x): %x => %x / Value: %s (log:%d)\n", vLog.Address.String(), event.From.String(), event.To.String(), event.Value.Text(10), vLog.Index)
+	}
+
+	return NotifyMessage{
+		MessageType:     NOTIFY_TYPE_TX,
+		AddressFrom:     event.From.Hex()[2:],
+		AddressTo:       event.To.Hex()[2:],
+		Amount:          event.Value,
+		ContractAddress: vLog.Address.Hex()[2:],
+		IsPending:       false,
+		TxHash:          vLog.TxHash.Hex()[2:],
+		LogIndex:        int(vLog.Index),
+		State:           NOTIFY_STATE_MINED,
+	}, nil
+}
+
+// ReadTransferLogs returns a message for each erc20 Transfer event emitted
+// in the given block, whatever the contract or call path that emitted it,
+// from the logs of its receipts.
+func ReadTransferLogs(block *types.Block, receipts map[string]*types.Receipt) []NotifyMessage {
+	messages := make([]NotifyMessage, 0)
+
+	for _, tx := range block.Transactions() {
+		receipt, ok := receipts[tx.Hash().Hex()[2:]]
+		if false == ok {
+			continue
+		}
+
+		for _, vLog := range receipt.Logs {
+			if vLog.Removed || len(vLog.Topics) == 0 || vLog.Topics[0] != transferEventTopic {
+				continue
+			}
+
+			message, err := ParseTransferLog(*vLog)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			if message.MessageType == NOTIFY_TYPE_NONE {
+				continue
+			}
+
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+// Receipts read per batch call, from nodes without eth_getBlockReceipts.
+const RECEIPTS_BATCH_SIZE = 100
+
+// ReadBlockReceipts returns the receipts of the transactions of a block, by
+// transaction hash: all of them with a single eth_getBlockReceipts call or,
+// if the node does not support it, with batches of eth_getTransactionReceipt
+// calls.
+func ReadBlockReceipts(ctx context.Context, client *ethclient.Client, block *types.Block) (map[string]*types.Receipt, error) {
+	txs := block.Transactions()
+	receipts := make(map[string]*types.Receipt)
+
+	if len(txs) == 0 {
+		return receipts, nil
+	}
+
+	var list []*types.Receipt
+
+	err := client.Client().CallContext(ctx, &list, "eth_getBlockReceipts", block.Hash())
+	if err == nil && len(list) == len(txs) {
+		for _, receipt := range list {
+			if receipt == nil || receipt.BlockHash != block.Hash() {
+				return nil, ErrNodeUnavailable.Errorf("ReadBlockReceipts(%s): receipts are not the ones of the block", block.Hash().Hex())
+			}
+
+			receipts[receipt.TxHash.Hex()[2:]] = receipt
+		}
+
+		return receipts, nil
+	}
+
+	for start := 0; start < len(txs); start += RECEIPTS_BATCH_SIZE {
+		end := start + RECEIPTS_BATCH_SIZE
+		if end > len(txs) {
+			end = len(txs)
+		}
+
+		results := make([]*types.Receipt, end-start)
+		batch := make([]rpc.BatchElem, 0, end-start)
+
+		for i, tx := range txs[start:end] {
+			batch = append(batch, rpc.BatchElem{
+				Method: "eth_getTransactionReceipt",
+				Args:   []interface{}{tx.Hash()},
+				Result: &results[i],
+			})
+		}
+
+		err = client.Client().BatchCallContext(ctx, batch)
+		if err != nil {
+			return nil, fmt.Errorf("ReadBlockReceipts(%s): %w", block.Hash().Hex(), NodeError(err))
+		}
+
+		for i, elem := range batch {
+			hash := txs[start+i].Hash()
+
+			if elem.Error != nil {
+				return nil, fmt.Errorf("ReadBlockReceipts: could not retrieve receipt of %s: %w", hash.Hex(), NodeError(elem.Error))
+			}
+
+			if results[i] == nil {
+				// The node does not have the receipts of the block it served.
+				return nil, ErrNodeUnavailable.Wrap(ethereum.NotFound, "ReadBlockReceipts: could not retrieve receipt of %s: %v", hash.Hex(), ethereum.NotFound)
+			}
+
+			receipts[hash.Hex()[2:]] = results[i]
+		}
+	}
+
+	return receipts, nil
+}
+
+func ReadBlock(ctx context.Context, client *ethclient.Client, hashStr string, number *big.Int) (*types.Block, []NotifyMessage, error) {
 	var block *types.Block
 	var err error
 	messages := make([]NotifyMessage, 0)
@@ -369,25 +626,58 @@ func ReadBlock(client *ethclient.Client, hashStr string, number *big.Int) (*big.
 	if hashStr != "" {
 		hash := common.HexToHash(hashStr)
 
-		block, err = client.BlockByHash(context.Background(), hash)
+		block, err = client.BlockByHash(ctx, hash)
 		if err != nil {
-			return nil, messages, fmt.Errorf("ReadBlock failed: %v", err)
+			return nil, messages, fmt.Errorf("ReadBlock failed: %w", NodeError(err))
 		}
 	} else {
-		block, err = client.BlockByNumber(context.Background(), number)
+		block, err = client.BlockByNumber(ctx, number)
 		if err != nil {
-			return nil, messages, fmt.Errorf("ReadBlock failed: %v", err)
+			return nil, messages, fmt.Errorf("ReadBlock failed: %w", NodeError(err))
 		}
 	}
 
+	receipts, err := ReadBlockReceipts(ctx, client, block)
+	if err != nil {
+		return block, messages, err
+	}
+
 	for _, tx := range block.Transactions() {
 		message, err := ParseTransaction(tx, false)
 		if err != nil {
-			return block.Number(), messages, err
+			return block, messages, err
+		}
+
+		// Mined erc20 transfers are read from their Transfer logs below.
+		// A failed one emits none: it is reported from its calldata, so it
+		// replaces its pending notification.
+		if message.ContractAddress != "" {
+			receipt, ok := receipts[message.TxHash]
+			if false == ok || receipt.Status != types.ReceiptStatusFailed {
+				continue
+			}
 		}
 
 		messages = append(messages, message)
 	}
 
-	return block.Number(), messages, nil
+	messages = append(messages, ReadTransferLogs(block, receipts)...)
+
+	for i := range messages {
+		messages[i].BlockNumber = block.NumberU64()
+		messages[i].BlockHash = block.Hash().Hex()[2:]
+		messages[i].Confirmations = 1
+
+		if receipt, ok := receipts[messages[i].TxHash]; ok {
+			messages[i].Status = TX_STATUS_SUCCESS
+			if receipt.Status == types.ReceiptStatusFailed {
+				messages[i].Status = TX_STATUS_FAILED
+			}
+
+			messages[i].GasUsed = receipt.GasUsed
+			messages[i].EffectiveGasPrice = receipt.EffectiveGasPrice
+		}
+	}
+
+	return block, messages, nil
 }
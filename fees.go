@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	// Blocks and reward percentile sampled with eth_feeHistory to suggest
+	// the priority fee of dynamic fee transactions.
+	FEE_HISTORY_BLOCKS     = 10
+	FEE_HISTORY_PERCENTILE = 50
+)
+
+// TxOptions are caller overrides for the gas limit and fees of an outgoing
+// transaction. Zero or nil values are computed automatically.
+type TxOptions struct {
+	GasLimit             uint64
+	GasPrice             *big.Int
+	MaxFeePerGas         *big.Int
+	MaxPriorityFeePerGas *big.Int
+}
+
+// TxFees are the fees a transaction is signed with: either a legacy gas
+// price, or EIP-1559 fee cap and tip cap.
+type TxFees struct {
+	Legacy    bool
+	GasPrice  *big.Int
+	GasFeeCap *big.Int
+	GasTipCap *big.Int
+}
+
+func GetChainID(ctx context.Context, config *Config, client *ethclient.Client) (*big.Int, error) {
+	if config.ChainID != 0 {
+		return new(big.Int).SetUint64(config.ChainID), nil
+	}
+
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve chain id: %w", NodeError(err))
+	}
+
+	return chainID, nil
+}
+
+// SuggestPriorityFee returns the median priority fee paid over the last
+// blocks, falling back on the node's suggestion.
+func SuggestPriorityFee(ctx context.Context, client *ethclient.Client) (*big.Int, error) {
+	history, err := client.FeeHistory(ctx, FEE_HISTORY_BLOCKS, nil, []float64{FEE_HISTORY_PERCENTILE})
+	if err == nil {
+		rewards := make([]*big.Int, 0, len(history.Reward))
+		for _, reward := range history.Reward {
+			if len(reward) > 0 && reward[0] != nil {
+				rewards = append(rewards, reward[0])
+			}
+		}
+
+		if len(rewards) > 0 {
+			sort.Slice(rewards, func(i, j int) bool {
+				return rewards[i].Cmp(rewards[j]) < 0
+			})
+
+			return rewards[len(rewards)/2], nil
+		}
+	}
+
+	return client.SuggestGasTipCap(ctx)
+}
+
+// SuggestFees returns the fees to sign a transaction with. Dynamic fees are
+// used when the chain supports EIP-1559 and no legacy gas price is forced.
+func SuggestFees(ctx context.Context, client *ethclient.Client, opts TxOptions) (TxFees, error) {
+	header, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return TxFees{}, fmt.Errorf("Could not retrieve latest header: %w", NodeError(err))
+	}
+
+	if opts.GasPrice != nil || header.BaseFee == nil {
+		gasPrice := opts.GasPrice
+		if gasPrice == nil {
+			gasPrice, err = client.SuggestGasPrice(ctx)
+			if err != nil {
+				return TxFees{}, fmt.Errorf("Could not suggest gas price: %w", NodeError(err))
+			}
+		}
+
+		return TxFees{Legacy: true, GasPrice: gasPrice}, nil
+	}
+
+	tip := opts.MaxPriorityFeePerGas
+	if tip == nil {
+		tip, err = SuggestPriorityFee(ctx, client)
+		if err != nil {
+			return TxFees{}, fmt.Errorf("Could not suggest priority fee: %w", NodeError(err))
+		}
+	}
+
+	feeCap := opts.MaxFeePerGas
+	if feeCap == nil {
+		// Leave room for the base fee to double before inclusion.
+		feeCap = new(big.Int).Mul(header.BaseFee, big.NewInt(2))
+		feeCap.Add(feeCap, tip)
+	}
+
+	if feeCap.Cmp(tip) < 0 {
+		return TxFees{}, ErrInvalidRequest.Errorf("max_fee_per_gas (%s) is lower than max_priority_fee_per_gas (%s)", feeCap, tip)
+	}
+
+	return TxFees{GasFeeCap: feeCap, GasTipCap: tip}, nil
+}
+
+func NewTransaction(chainID *big.Int, nonce uint64, to common.Address, value *big.Int, gasLimit uint64, fees TxFees, data []byte) *types.Transaction {
+	if fees.Legacy {
+		return types.NewTx(&types.LegacyTx{
+			Nonce:    nonce,
+			To:       &to,
+			Value:    value,
+			Gas:      gasLimit,
+			GasPrice: fees.GasPrice,
+			Data:     data,
+		})
+	}
+
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     nonce,
+		To:        &to,
+		Value:     value,
+		Gas:       gasLimit,
+		GasFeeCap: fees.GasFeeCap,
+		GasTipCap: fees.GasTipCap,
+		Data:      data,
+	})
+}
+
+// Minimum fee increase, in percent, for a node to accept a transaction
+// replacing another one with the same nonce.
+const REPLACEMENT_FEE_BUMP = 10
+
+func bumpFee(fee *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(100+REPLACEMENT_FEE_BUMP))
+	bumped.Div(bumped, big.NewInt(100))
+
+	return bumped.Add(bumped, big.NewInt(1))
+}
+
+func maxFee(fees ...*big.Int) *big.Int {
+	max := fees[0]
+	for _, fee := range fees[1:] {
+		if fee.Cmp(max) > 0 {
+			max = fee
+		}
+	}
+
+	return max
+}
+
+// ReplacementFees returns the fees to replace the given transaction with:
+// at least the current suggestion, and enough above the replaced fees to
+// follow the replace-by-fee rules. The transaction type is kept.
+func ReplacementFees(ctx context.Context, client *ethclient.Client, tx *types.Transaction, opts TxOptions) (TxFees, error) {
+	if tx.Type() != types.DynamicFeeTxType {
+		minimum := bumpFee(tx.GasPrice())
+
+		if opts.MaxFeePerGas != nil || opts.MaxPriorityFeePerGas != nil {
+			return TxFees{}, ErrInvalidRequest.Errorf("A legacy transaction must be replaced using 'gas_price'")
+		}
+
+		gasPrice := opts.GasPrice
+		if gasPrice == nil {
+			suggested, err := client.SuggestGasPrice(ctx)
+			if err != nil {
+				return TxFees{}, fmt.Errorf("Could not suggest gas price: %w", NodeError(err))
+			}
+
+			gasPrice = maxFee(suggested, minimum)
+		} else if gasPrice.Cmp(minimum) < 0 {
+			return TxFees{}, ErrReplacementUnderpriced.Errorf("Replacement underpriced: gas_price must be at least %s", minimum)
+		}
+
+		return TxFees{Legacy: true, GasPrice: gasPrice}, nil
+	}
+
+	if opts.GasPrice != nil {
+		return TxFees{}, ErrInvalidRequest.Errorf("A dynamic fee transaction can't be replaced using 'gas_price'")
+	}
+
+	minimumTip := bumpFee(tx.GasTipCap())
+	minimumFeeCap := bumpFee(tx.GasFeeCap())
+
+	suggested, err := SuggestFees(ctx, client, TxOptions{})
+	if err != nil {
+		return TxFees{}, err
+	}
+
+	if suggested.Legacy {
+		suggested = TxFees{GasFeeCap: minimumFeeCap, GasTipCap: minimumTip}
+	}
+
+	tip := opts.MaxPriorityFeePerGas
+	if tip == nil {
+		tip = maxFee(suggested.GasTipCap, minimumTip)
+	} else if tip.Cmp(minimumTip) < 0 {
+		return TxFees{}, ErrReplacementUnderpriced.Errorf("Replacement underpriced: max_priority_fee_per_gas must be at least %s", minimumTip)
+	}
+
+	feeCap := opts.MaxFeePerGas
+	if feeCap == nil {
+		feeCap = maxFee(suggested.GasFeeCap, minimumFeeCap, tip)
+	} else if feeCap.Cmp(minimumFeeCap) < 0 {
+		return TxFees{}, ErrReplacementUnderpriced.Errorf("Replacement underpriced: max_fee_per_gas must be at least %s", minimumFeeCap)
+	}
+
+	if feeCap.Cmp(tip) < 0 {
+		return TxFees{}, ErrInvalidRequest.Errorf("max_fee_per_gas (%s) is lower than max_priority_fee_per_gas (%s)", feeCap, tip)
+	}
+
+	return TxFees{GasFeeCap: feeCap, GasTipCap: tip}, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	// Attempts to read a block before giving up on it.
+	BLOCK_FETCH_ATTEMPTS = 5
+
+	// Delay before reading again a block which could not be read.
+	BLOCK_FETCH_RETRY_DELAY = time.Second
+)
+
+var ErrBlockFetch = errors.New("Could not read block")
+
+// FetchedBlock is a block read by FetchBlocks, or the error which stopped
+// them.
+type FetchedBlock struct {
+	Block *types.Block
+	Txns  []NotifyMessage
+	Err   error
+}
+
+func fetchBlock(config *Config, client *ethclient.Client, number uint64) FetchedBlock {
+	var err error
+
+	for attempt := 1; attempt <= BLOCK_FETCH_ATTEMPTS; attempt++ {
+		var block *types.Block
+		var txns []NotifyMessage
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.RPCTimeout)
+		block, txns, err = ReadBlock(ctx, client, "", new(big.Int).SetUint64(number))
+		cancel()
+		if err == nil {
+			return FetchedBlock{block, txns, nil}
+		}
+
+		log.Printf("FetchBlocks: Block %d (attempt %d/%d): %v", number, attempt, BLOCK_FETCH_ATTEMPTS, err)
+
+		if attempt < BLOCK_FETCH_ATTEMPTS {
+			time.Sleep(BLOCK_FETCH_RETRY_DELAY)
+		}
+	}
+
+	return FetchedBlock{Err: fmt.Errorf("%w %d: %w", ErrBlockFetch, number, err)}
+}
+
+// FetchBlocks reads the blocks from "from" to "to" (included) with up to
+// block_fetch_concurrency blocks read at once, and returns them in order. A block which
+// can't be read after BLOCK_FETCH_ATTEMPTS is returned with its error, and
+// ends the blocks returned. Closing done stops the reads when the blocks
+// left are not wanted any longer.
+func FetchBlocks(config *Config, client *ethclient.Client, from, to uint64, done <-chan struct{}) <-chan FetchedBlock {
+	out := make(chan FetchedBlock)
+	inflight := make(chan chan FetchedBlock, config.BlockFetchConcurrency)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(inflight)
+
+		for number := from; number <= to; number++ {
+			result := make(chan FetchedBlock, 1)
+
+			select {
+			case inflight <- result:
+			case <-stop:
+				return
+			}
+
+			go func(number uint64) {
+				result <- fetchBlock(config, client, number)
+			}(number)
+		}
+	}()
+
+	go func() {
+		defer close(out)
+
+		for result := range inflight {
+			fetched := <-result
+
+			stopped := false
+			select {
+			case out <- fetched:
+				stopped = fetched.Err != nil
+			case <-done:
+				stopped = true
+			}
+
+			if stopped {
+				close(stop)
+				break
+			}
+		}
+
+		// Wait for the reads already started.
+		for result := range inflight {
+			<-result
+		}
+	}()
+
+	return out
+}
+
+// TransactionWorkers looks up pending transactions on the node in use with
+// tx_workers workers, and returns the queue to send their hashes to.
+func TransactionWorkers(config *Config, pool *NodePool, notifyChannel chan<- NotifyMessage) chan<- string {
+	hashes := make(chan string, config.TxQueueSize)
+
+	for i := 0; i < config.TxWorkers; i++ {
+		go func() {
+			for hash := range hashes {
+				client := pool.Client()
+
+				ctx, cancel := context.WithTimeout(context.Background(), config.RPCTimeout)
+				txn, err := ReadTransaction(ctx, client, hash)
+				cancel()
+				pool.Report(client, err)
+				if err != nil {
+					log.Println("Listener:", err)
+					continue
+				}
+
+				notifyChannel <- txn
+			}
+		}()
+	}
+
+	return hashes
+}
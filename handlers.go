@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 func Respond(w http.ResponseWriter, code int, payload interface{}) {
@@ -28,31 +32,51 @@ func Respond(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
-func RespondWithError(w http.ResponseWriter, code int, msg string) {
-	Respond(w, code, map[string]string{"error": msg})
+// RespondWithError responds with the message and the code of an error, and
+// the HTTP status of its kind.
+func RespondWithError(w http.ResponseWriter, err error) {
+	kind := GetAPIError(err)
+
+	// Internal errors may carry database or driver details: they are only
+	// logged.
+	if kind == ErrInternal {
+		log.Printf("Internal error: %v", err)
+		Respond(w, kind.Status, map[string]string{"error": "Internal error", "code": kind.Code})
+		return
+	}
+
+	Respond(w, kind.Status, map[string]string{"error": err.Error(), "code": kind.Code})
+}
+
+// rpcContext bounds the node calls of a request: they are cancelled when the
+// client goes away, or after the configured timeout.
+func rpcContext(config *Config, r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), config.RPCTimeout)
 }
 
 func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("404: %s %s", r.Method, r.URL)
-	RespondWithError(w, 404, "Not found")
+	RespondWithError(w, ErrNotFound.Errorf("Not found"))
 }
 
-func CreateAddressHandler(config *Config, db *DB) func(w http.ResponseWriter, r *http.Request) {
+func CreateAddressHandler(config *Config, db Store, addresses *AddressSet) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		with_private := r.URL.Query().Get("with_private")
 
 		pub, priv, err := CreateAddress()
 		if err != nil {
-			RespondWithError(w, 500, fmt.Sprintf("Could not create a new key: %v", err))
+			RespondWithError(w, fmt.Errorf("Could not create a new key: %w", err))
 			return
 		}
 
 		err = db.InsertKey(pub, priv)
 		if err != nil {
-			RespondWithError(w, 500, fmt.Sprintf("Could not save newly created key: %v", err))
+			RespondWithError(w, fmt.Errorf("Could not save newly created key: %w", err))
 			return
 		}
 
+		addresses.Add(pub)
+
 		log.Printf("Created address: %v", pub)
 
 		if with_private == "true" {
@@ -64,12 +88,12 @@ func CreateAddressHandler(config *Config, db *DB) func(w http.ResponseWriter, r
 	}
 }
 
-func RegisterAddressHandler(config *Config, db *DB) func(w http.ResponseWriter, r *http.Request) {
+func RegisterAddressHandler(config *Config, db Store, addresses *AddressSet) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
 			log.Printf("RegisterAddressHandler: Could not parse body parameters")
-			RespondWithError(w, 400, "Could not parse parameters")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Could not parse parameters"))
 			return
 		}
 
@@ -78,7 +102,7 @@ func RegisterAddressHandler(config *Config, db *DB) func(w http.ResponseWriter,
 
 		if false == IsAddress(address) {
 			log.Printf("Invalid 'address' field: Not an hex address")
-			RespondWithError(w, 400, "Invalid 'address' field: Not an hex address")
+			RespondWithError(w, ErrInvalidAddress.Errorf("Invalid 'address' field: Not an hex address"))
 			return
 		}
 
@@ -86,13 +110,13 @@ func RegisterAddressHandler(config *Config, db *DB) func(w http.ResponseWriter,
 			addressVerify, err := PrivateHexToAddress(private)
 			if err != nil {
 				log.Printf("Invalid 'private' field: Could not transform to private key")
-				RespondWithError(w, 400, "Invalid 'private' field: Could not transform to private key")
+				RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'private' field: Could not transform to private key"))
 				return
 			}
 
 			if address != addressVerify {
 				log.Printf("Given 'address' and 'private' key doesn't match.")
-				RespondWithError(w, 400, "Given 'address' and 'private' key doesn't match.")
+				RespondWithError(w, ErrInvalidRequest.Errorf("Given 'address' and 'private' key doesn't match."))
 				return
 			}
 		}
@@ -100,15 +124,17 @@ func RegisterAddressHandler(config *Config, db *DB) func(w http.ResponseWriter,
 		// InsertKey will UPSERT.
 		err = db.InsertKey(address, private)
 		if err != nil {
-			RespondWithError(w, 500, fmt.Sprintf("Could not save newly created key: %v", err))
+			RespondWithError(w, fmt.Errorf("Could not save newly created key: %w", err))
 			return
 		}
 
+		addresses.Add(address)
+
 		Respond(w, 200, map[string]string{"message": "Address saved in database"})
 	}
 }
 
-func GetBalanceHandler(config *Config) func(w http.ResponseWriter, r *http.Request) {
+func GetBalanceHandler(config *Config, pool *NodePool) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var balance *big.Int
 		var err error
@@ -117,167 +143,721 @@ func GetBalanceHandler(config *Config) func(w http.ResponseWriter, r *http.Reque
 		contractAddress := r.URL.Query().Get("contract")
 
 		if address == "" {
-			RespondWithError(w, 400, "Missing 'address' field")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Missing 'address' field"))
 			return
 		}
 
+		if false == IsAddress(address) || (contractAddress != "" && false == IsAddress(contractAddress)) {
+			RespondWithError(w, ErrInvalidAddress.Errorf("Invalid 'address' or 'contract' field: Not an hex address"))
+			return
+		}
+
+		ctx, cancel := rpcContext(config, r)
+		defer cancel()
+
+		client := pool.Client()
+
+		var decimals uint8 = ETH_DECIMALS
+
 		if contractAddress == "" {
 			// Retrieve ETH balance
-			balanceFloat, err := GetAddressBalance(config, address)
+			balance, err = GetAddressBalance(ctx, client, address)
+			pool.Report(client, err)
 			if err != nil {
-				RespondWithError(w, 500, fmt.Sprintf("Could not retrieve ethereum balance: %v", err))
+				RespondWithError(w, fmt.Errorf("Could not retrieve ethereum balance: %w", err))
 				return
 			}
-
-			Respond(w, 200, map[string]string{"balance": balanceFloat.Text('f', 10)})
 		} else {
 			// Retrieve erc20 balance for given address
-			balance, err = GetERC20AddressBalance(config, address, contractAddress)
+			balance, err = GetERC20AddressBalance(ctx, client, address, contractAddress)
+			pool.Report(client, err)
+			if err != nil {
+				RespondWithError(w, fmt.Errorf("Could not retrieve ethereum balance: %w", err))
+				return
+			}
+
+			decimals, err = GetERC20Decimals(ctx, client, contractAddress)
+			pool.Report(client, err)
 			if err != nil {
-				RespondWithError(w, 500, fmt.Sprintf("Could not retrieve ethereum balance: %v", err))
+				RespondWithError(w, fmt.Errorf("Could not retrieve ethereum balance: %w", err))
 				return
 			}
+		}
+
+		// 'balance' is kept as it always was: ETH with 10 decimals, or
+		// base units of the token.
+		legacy := balance.Text(10)
+		if contractAddress == "" {
+			wei := new(big.Float)
+			wei.UnmarshalText([]byte("0.000000000000000001"))
+			legacy = new(big.Float).Mul(wei, new(big.Float).SetInt(balance)).Text('f', 10)
+		}
+
+		Respond(w, 200, map[string]string{
+			"balance":   legacy,
+			"formatted": FormatAmount(balance, decimals),
+			"raw":       balance.Text(10),
+			"decimals":  strconv.Itoa(int(decimals)),
+		})
+	}
+}
+
+// GetSigningKey returns the private key to sign a transaction with: the one
+// stored for 'address_from', or the raw 'private' field when allowed.
+func GetSigningKey(config *Config, db Store, r *http.Request) (string, error) {
+	addressFrom := r.Form.Get("address_from")
+	private := r.Form.Get("private")
+
+	if private != "" {
+		if false == config.AllowPrivateKeys {
+			return "", ErrInvalidRequest.Errorf("'private' field is not accepted: Use 'address_from'")
+		}
+
+		if addressFrom != "" {
+			address, err := PrivateHexToAddress(private)
+			if err != nil {
+				return "", ErrInvalidRequest.Errorf("Invalid 'private' field: Could not transform to private key")
+			}
+
+			if false == strings.EqualFold(strings.TrimPrefix(addressFrom, "0x"), address) {
+				return "", ErrInvalidRequest.Errorf("Given 'address_from' and 'private' key doesn't match.")
+			}
+		}
+
+		return private, nil
+	}
+
+	if addressFrom == "" {
+		if config.AllowPrivateKeys {
+			return "", ErrInvalidRequest.Errorf("'address_from' and 'private' fields are both missing. At least one is mandatory")
+		}
+
+		return "", ErrInvalidRequest.Errorf("Missing 'address_from' field")
+	}
+
+	if false == IsAddress(addressFrom) {
+		return "", ErrInvalidAddress.Errorf("Invalid 'address_from' field: Not an hex address")
+	}
+
+	private, err := db.GetKey(strings.TrimPrefix(addressFrom, "0x"))
+	if errors.Is(err, ErrUnknownKey) {
+		return "", err
+	}
+	if err != nil {
+		log.Printf("Could not retrieve the address_from private key: %v", err)
+		return "", fmt.Errorf("Error while retrieving the private key: %w", err)
+	}
+
+	if private == "" {
+		return "", ErrUnknownKey.Errorf("Unknown private key for %s", addressFrom)
+	}
+
+	return private, nil
+}
+
+// ParseTxOptions reads the optional gas limit and fees overrides (in wei) of
+// a send request.
+func ParseTxOptions(r *http.Request) (TxOptions, error) {
+	var opts TxOptions
+	var err error
+
+	if value := r.Form.Get("gas_limit"); value != "" {
+		opts.GasLimit, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return opts, ErrInvalidRequest.Errorf("Invalid 'gas_limit' field: %v", err)
+		}
+	}
+
+	fields := map[string]**big.Int{
+		"gas_price":                &opts.GasPrice,
+		"max_fee_per_gas":          &opts.MaxFeePerGas,
+		"max_priority_fee_per_gas": &opts.MaxPriorityFeePerGas,
+	}
 
-			Respond(w, 200, map[string]string{"balance": balance.Text(10)})
+	for name, field := range fields {
+		value := r.Form.Get(name)
+		if value == "" {
+			continue
 		}
+
+		bgValue, ok := new(big.Int).SetString(value, 10)
+		if false == ok || bgValue.Sign() < 0 {
+			return opts, ErrInvalidRequest.Errorf("Invalid '%s' field: Not an amount of wei", name)
+		}
+
+		*field = bgValue
+	}
+
+	if opts.GasPrice != nil && (opts.MaxFeePerGas != nil || opts.MaxPriorityFeePerGas != nil) {
+		return opts, ErrInvalidRequest.Errorf("'gas_price' can't be used with 'max_fee_per_gas' or 'max_priority_fee_per_gas'")
 	}
+
+	return opts, nil
 }
 
-func SendEthHandler(config *Config) func(w http.ResponseWriter, r *http.Request) {
+func SendEthHandler(config *Config, db Store, pool *NodePool, nonces *NonceManager) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
 			log.Printf("SendEthHandler: Could not parse body parameters")
-			RespondWithError(w, 400, "Could not parse parameters")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Could not parse parameters"))
 			return
 		}
 
 		address := r.Form.Get("address")
-		private := r.Form.Get("private")
 		amount := r.Form.Get("amount")
 
 		if address == "" {
 			log.Printf("Got Send Ethereum order but 'address' field is missing")
-			RespondWithError(w, 400, "Missing 'address' field")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Missing 'address' field"))
 			return
 		}
 
-		if private == "" {
-			log.Printf("Got Send Ethereum order but 'private' field is missing")
-			RespondWithError(w, 400, "Missing 'private' field")
+		if false == IsAddress(address) {
+			RespondWithError(w, ErrInvalidAddress.Errorf("Invalid 'address' field: Not an hex address"))
 			return
 		}
 
 		if amount == "" {
 			log.Printf("Got Send Ethereum order but 'amount' field is missing")
-			RespondWithError(w, 400, "Missing 'amount' field")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Missing 'amount' field"))
+			return
+		}
+
+		private, err := GetSigningKey(config, db, r)
+		if err != nil {
+			log.Printf("Got Send Ethereum order but could not get signing key: %v", err)
+			RespondWithError(w, err)
+			return
+		}
+
+		unit := r.Form.Get("unit")
+		if unit == "" {
+			unit = "ether"
+		}
+
+		decimals, ok := ETH_UNITS[unit]
+		if false == ok {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'unit' field: Must be wei, gwei or ether"))
 			return
 		}
 
-		f, err := strconv.ParseFloat(amount, 64)
+		bgAmountInt, err := ParseAmount(amount, decimals)
 		if err != nil {
-			RespondWithError(w, 400, "Could not convert amount")
+			RespondWithError(w, err)
 			return
 		}
 
-		bgAmount := new(big.Float)
-		bgAmount.SetFloat64(f)
+		opts, err := ParseTxOptions(r)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
 
-		bgEthWei := new(big.Float)
-		bgEthWei.SetString("1000000000000000000")
+		ctx, cancel := rpcContext(config, r)
+		defer cancel()
 
-		bgAmount = bgAmount.Mul(bgAmount, bgEthWei)
-		bgAmountInt, _ := bgAmount.Int(new(big.Int))
+		client := pool.Client()
 
-		tx, err := SendEthCoin(config, bgAmountInt, private, address)
+		tx, err := SendEthCoin(ctx, config, client, nonces, bgAmountInt, private, address, opts)
+		pool.Report(client, err)
 		if err != nil {
-			RespondWithError(w, 500, fmt.Sprintf("Could not send Ethereum coin: %v", err))
+			RespondWithError(w, fmt.Errorf("Could not send Ethereum coin: %w", err))
 			return
 		}
 
-		Respond(w, 200, map[string]string{"txhash": tx})
+		RecordTransaction(config, db, tx, address, "", bgAmountInt)
+
+		Respond(w, 200, map[string]string{"txhash": tx.Hash().String()})
 	}
 }
 
-func SendERC20Handler(config *Config, db *DB) func(w http.ResponseWriter, r *http.Request) {
+func SendERC20Handler(config *Config, db Store, pool *NodePool, nonces *NonceManager) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
 			log.Printf("SendERC20Handler: Could not parse body parameters")
-			RespondWithError(w, 400, "Could not parse parameters")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Could not parse parameters"))
 			return
 		}
 
 		address := r.Form.Get("address")
-		addressFrom := r.Form.Get("address_from")
 		contract := r.Form.Get("contract")
-		private := r.Form.Get("private")
 		amount := r.Form.Get("amount")
 
 		if address == "" {
 			log.Printf("Got Send Ethereum order but 'address' field is missing")
-			RespondWithError(w, 400, "Missing 'address' field")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Missing 'address' field"))
 			return
 		}
 
 		if contract == "" {
 			log.Printf("Got Send Ethereum order but 'contract' field is missing")
-			RespondWithError(w, 400, "Missing 'contract' field")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Missing 'contract' field"))
 			return
 		}
 
-		if private == "" || addressFrom == "" {
-			log.Printf("Got Send Ethereum order but 'private' and 'address_from' fields are missing")
-			RespondWithError(w, 400, "'address_from' and'private' fields are both missing. At least one is mandatory ")
+		if false == IsAddress(address) || false == IsAddress(contract) {
+			RespondWithError(w, ErrInvalidAddress.Errorf("Invalid 'address' or 'contract' field: Not an hex address"))
 			return
 		}
 
 		if amount == "" {
 			log.Printf("Got Send Ethereum order but 'amount' field is missing")
-			RespondWithError(w, 400, "Missing 'amount' field")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Missing 'amount' field"))
+			return
+		}
+
+		private, err := GetSigningKey(config, db, r)
+		if err != nil {
+			log.Printf("Got Send ERC20 order but could not get signing key: %v", err)
+			RespondWithError(w, err)
+			return
+		}
+
+		unit := r.Form.Get("unit")
+		if unit != "" && unit != "base" && unit != "token" {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'unit' field: Must be base or token"))
+			return
+		}
+
+		opts, err := ParseTxOptions(r)
+		if err != nil {
+			RespondWithError(w, err)
 			return
 		}
 
-		if private == "" {
-			private, err := db.GetKey(addressFrom)
+		ctx, cancel := rpcContext(config, r)
+		defer cancel()
+
+		client := pool.Client()
+
+		// Amounts are in base units, or in tokens with the decimals of the
+		// contract.
+		var decimals uint8
+		if unit == "token" {
+			decimals, err = GetERC20Decimals(ctx, client, contract)
+			pool.Report(client, err)
 			if err != nil {
-				log.Printf("Could not retrieve the address_from private key: %v", err)
-				RespondWithError(w, 400, fmt.Sprintf("Error while retrieving the private key: %v", err))
+				RespondWithError(w, fmt.Errorf("Could not send ERC20 token: %w", err))
 				return
 			}
+		}
 
-			if private == "" {
-				log.Printf("Private key of given address_from is not known.")
-				RespondWithError(w, 400, fmt.Sprintf("Unknown private key for %s", addressFrom))
-				return
-			}
+		bgAmount, err := ParseAmount(amount, decimals)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+
+		tx, err := SendERC20Token(ctx, config, client, nonces, bgAmount, contract, private, address, opts)
+		pool.Report(client, err)
+		if err != nil {
+			RespondWithError(w, fmt.Errorf("Could not send ERC20 token: %w", err))
+			return
+		}
+
+		RecordTransaction(config, db, tx, address, contract, bgAmount)
+
+		Respond(w, 200, map[string]string{"txhash": tx.Hash().String()})
+	}
+}
+
+// ReplaceTransactionHandler re-signs a pending transaction with higher fees,
+// to speed it up or, if cancel is set, to cancel it.
+func ReplaceTransactionHandler(config *Config, db Store, pool *NodePool, cancel bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			log.Printf("ReplaceTransactionHandler: Could not parse body parameters")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Could not parse parameters"))
+			return
+		}
+
+		txhash := r.Form.Get("txhash")
+		if txhash == "" {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Missing 'txhash' field"))
+			return
+		}
+
+		old, err := db.GetTransaction(NormalizeTxHash(txhash))
+		if errors.Is(err, sql.ErrNoRows) {
+			RespondWithError(w, ErrNotFound.Errorf("Unknown transaction %s", txhash))
+			return
+		}
+		if err != nil {
+			log.Printf("ReplaceTransactionHandler: %v", err)
+			RespondWithError(w, ErrInternal.Errorf("Could not retrieve transaction"))
+			return
+		}
+
+		// The replacement must be signed by the sender of the transaction.
+		r.Form.Set("address_from", old.AddressFrom)
+
+		private, err := GetSigningKey(config, db, r)
+		if err != nil {
+			log.Printf("Got replace order but could not get signing key: %v", err)
+			RespondWithError(w, err)
+			return
+		}
+
+		opts, err := ParseTxOptions(r)
+		if err != nil {
+			RespondWithError(w, err)
+			return
 		}
 
-		bgAmount := new(big.Int)
-		bgAmount.UnmarshalText([]byte(amount))
+		ctx, stop := rpcContext(config, r)
+		defer stop()
+
+		client := pool.Client()
 
-		tx, err := SendERC20Token(config, bgAmount, contract, private, address)
+		tx, err := ReplaceTransaction(ctx, config, db, client, old, private, opts, cancel)
+		pool.Report(client, err)
 		if err != nil {
-			RespondWithError(w, 500, fmt.Sprintf("Could not send ERC20 token: %v", err))
+			RespondWithError(w, fmt.Errorf("Could not replace transaction: %w", err))
 			return
 		}
 
-		Respond(w, 200, map[string]string{"txhash": tx})
+		Respond(w, 200, map[string]string{"txhash": tx.Hash().String(), "replaces": "0x" + old.TxHash})
 	}
 }
 
-func GetNotificationsHandler(config *Config, db *DB) func(w http.ResponseWriter, r *http.Request) {
+// GetNotificationsHandler returns the notifications recorded after a cursor:
+// the 'after' id, or the last id acknowledged by 'consumer'.
+func GetNotificationsHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		remove := r.URL.Query().Get("remove")
+		var after uint64
+		var err error
+
+		query := r.URL.Query()
+		state := query.Get("state")
+		consumer := query.Get("consumer")
+		limit := DEFAULT_NOTIFICATIONS_LIMIT
+
+		if query.Get("remove") != "" {
+			RespondWithError(w, ErrInvalidRequest.Errorf("'remove' is no longer supported: Acknowledge notifications with /ackNotifications"))
+			return
+		}
+
+		if state != "" && false == IsNotifyState(state) {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'state' field: Must be one of pending, mined, confirmed, final, orphaned, reverted, failed, dropped or replaced"))
+			return
+		}
+
+		if value := query.Get("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit <= 0 || limit > MAX_NOTIFICATIONS_LIMIT {
+				RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'limit' field: Must be between 1 and %d", MAX_NOTIFICATIONS_LIMIT))
+				return
+			}
+		}
 
-		// Retrieve next 100 records in database
-		notifications, err := db.GetNotifications(remove == "true")
+		if value := query.Get("after"); value != "" {
+			after, err = strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'after' field: Not a notification id"))
+				return
+			}
+		} else if consumer != "" {
+			acked, err := db.GetConsumer(consumer)
+			if err != nil && false == errors.Is(err, sql.ErrNoRows) {
+				log.Printf("GetNotificationsHandler: %v", err)
+				RespondWithError(w, ErrInternal.Errorf("Could not retrieve consumer"))
+				return
+			}
+
+			after = acked.AckedID
+		}
+
+		notifications, err := db.GetNotifications(after, limit, state)
 		if err != nil {
 			log.Printf("GetNotificationsHandler: %v", err)
-			RespondWithError(w, 500, "Could retrieve notifications")
+			RespondWithError(w, ErrInternal.Errorf("Could not retrieve notifications"))
 			return
 		}
 
 		Respond(w, 200, notifications)
 	}
 }
+
+func AckNotificationsHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			log.Printf("AckNotificationsHandler: Could not parse body parameters")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Could not parse parameters"))
+			return
+		}
+
+		name := r.Form.Get("consumer")
+		if name == "" || len(name) > 64 {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'consumer' field: Must be a name of 1 to 64 characters"))
+			return
+		}
+
+		id, err := strconv.ParseUint(r.Form.Get("id"), 10, 64)
+		if err != nil {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'id' field: Not a notification id"))
+			return
+		}
+
+		consumer, err := db.AckNotifications(name, id)
+		if err != nil {
+			log.Printf("AckNotificationsHandler: %v", err)
+			RespondWithError(w, ErrInternal.Errorf("Could not acknowledge notifications"))
+			return
+		}
+
+		Respond(w, 200, consumer)
+	}
+}
+
+func GetConsumersHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		consumers, err := db.GetConsumers()
+		if err != nil {
+			log.Printf("GetConsumersHandler: %v", err)
+			RespondWithError(w, ErrInternal.Errorf("Could not retrieve consumers"))
+			return
+		}
+
+		Respond(w, 200, consumers)
+	}
+}
+
+func RemoveConsumerHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			log.Printf("RemoveConsumerHandler: Could not parse body parameters")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Could not parse parameters"))
+			return
+		}
+
+		name := r.Form.Get("consumer")
+		if name == "" {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Missing 'consumer' field"))
+			return
+		}
+
+		err = db.DeleteConsumer(name)
+		if errors.Is(err, sql.ErrNoRows) {
+			RespondWithError(w, ErrNotFound.Errorf("Unknown consumer %s", name))
+			return
+		}
+		if err != nil {
+			log.Printf("RemoveConsumerHandler: %v", err)
+			RespondWithError(w, ErrInternal.Errorf("Could not remove consumer"))
+			return
+		}
+
+		Respond(w, 200, map[string]string{"message": "Consumer removed"})
+	}
+}
+
+func GetTransactionHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txhash := r.URL.Query().Get("txhash")
+
+		if txhash == "" {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Missing 'txhash' field"))
+			return
+		}
+
+		tx, err := db.GetTransaction(NormalizeTxHash(txhash))
+		if errors.Is(err, sql.ErrNoRows) {
+			RespondWithError(w, ErrNotFound.Errorf("Unknown transaction %s", txhash))
+			return
+		}
+		if err != nil {
+			log.Printf("GetTransactionHandler: %v", err)
+			RespondWithError(w, ErrInternal.Errorf("Could not retrieve transaction"))
+			return
+		}
+
+		Respond(w, 200, tx)
+	}
+}
+
+func RegisterWebhookHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			log.Printf("RegisterWebhookHandler: Could not parse body parameters")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Could not parse parameters"))
+			return
+		}
+
+		if r.Form.Get("url") == "" {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Missing 'url' field"))
+			return
+		}
+
+		hook, err := NewWebhook(r.Form.Get("url"), r.Form.Get("address"), r.Form.Get("secret"))
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+
+		err = db.InsertWebhook(hook)
+		if err != nil {
+			log.Printf("RegisterWebhookHandler: %v", err)
+			RespondWithError(w, ErrInternal.Errorf("Could not save webhook"))
+			return
+		}
+
+		log.Printf("Registered webhook %s: %s", hook.ID, hook.URL)
+
+		Respond(w, 200, hook)
+	}
+}
+
+func RemoveWebhookHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			log.Printf("RemoveWebhookHandler: Could not parse body parameters")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Could not parse parameters"))
+			return
+		}
+
+		id := r.Form.Get("id")
+		if id == "" {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Missing 'id' field"))
+			return
+		}
+
+		err = db.DeleteWebhook(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			RespondWithError(w, ErrNotFound.Errorf("Unknown webhook %s", id))
+			return
+		}
+		if err != nil {
+			log.Printf("RemoveWebhookHandler: %v", err)
+			RespondWithError(w, ErrInternal.Errorf("Could not remove webhook"))
+			return
+		}
+
+		Respond(w, 200, map[string]string{"message": "Webhook removed"})
+	}
+}
+
+func GetWebhooksHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hooks, err := db.GetWebhooks()
+		if err != nil {
+			log.Printf("GetWebhooksHandler: %v", err)
+			RespondWithError(w, ErrInternal.Errorf("Could not retrieve webhooks"))
+			return
+		}
+
+		// Secrets are only returned at registration.
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+
+		Respond(w, 200, hooks)
+	}
+}
+
+func GetWebhookDeliveriesHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhookID := r.URL.Query().Get("webhook_id")
+		status := r.URL.Query().Get("status")
+
+		if status != "" && false == IsDeliveryStatus(status) {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'status' field: Must be one of pending, delivered or dead"))
+			return
+		}
+
+		deliveries, err := db.GetDeliveries(webhookID, status)
+		if err != nil {
+			log.Printf("GetWebhookDeliveriesHandler: %v", err)
+			RespondWithError(w, ErrInternal.Errorf("Could not retrieve webhook deliveries"))
+			return
+		}
+
+		Respond(w, 200, deliveries)
+	}
+}
+
+func ReplayWebhookDeliveriesHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id uint64
+
+		err := r.ParseForm()
+		if err != nil {
+			log.Printf("ReplayWebhookDeliveriesHandler: Could not parse body parameters")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Could not parse parameters"))
+			return
+		}
+
+		webhookID := r.Form.Get("webhook_id")
+
+		if value := r.Form.Get("id"); value != "" {
+			id, err = strconv.ParseUint(value, 10, 64)
+			if err != nil || id == 0 {
+				RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'id' field: Not a delivery id"))
+				return
+			}
+		}
+
+		if id == 0 && webhookID == "" {
+			RespondWithError(w, ErrInvalidRequest.Errorf("'id' and 'webhook_id' fields are both missing. At least one is mandatory"))
+			return
+		}
+
+		count, err := db.ReplayDeliveries(webhookID, id)
+		if err != nil {
+			log.Printf("ReplayWebhookDeliveriesHandler: %v", err)
+			RespondWithError(w, ErrInternal.Errorf("Could not replay webhook deliveries"))
+			return
+		}
+
+		Respond(w, 200, map[string]int64{"replayed": count})
+	}
+}
+
+func RescanHandler(config *Config, db Store, addresses *AddressSet, rescanner *Rescanner) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			log.Printf("RescanHandler: Could not parse body parameters")
+			RespondWithError(w, ErrInvalidRequest.Errorf("Could not parse parameters"))
+			return
+		}
+
+		from, err := strconv.ParseUint(r.Form.Get("from"), 10, 64)
+		if err != nil {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'from' field: Not a block number"))
+			return
+		}
+
+		to, err := strconv.ParseUint(r.Form.Get("to"), 10, 64)
+		if err != nil {
+			RespondWithError(w, ErrInvalidRequest.Errorf("Invalid 'to' field: Not a block number"))
+			return
+		}
+
+		err = rescanner.Start(config, db, addresses, from, to, r.Form.Get("address"))
+		if err != nil {
+			RespondWithError(w, fmt.Errorf("Could not start rescan: %w", err))
+			return
+		}
+
+		Respond(w, 202, rescanner.Status())
+	}
+}
+
+func GetRescanHandler(config *Config, rescanner *Rescanner) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		Respond(w, 200, rescanner.Status())
+	}
+}
+
+func GetNodesHandler(config *Config, pool *NodePool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		Respond(w, 200, pool.Status())
+	}
+}
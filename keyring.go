@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeySource tells where to read a master key from: a file or an environment
+// variable holding 32 hex encoded bytes, or a passphrase derived with scrypt.
+type KeySource struct {
+	File       string
+	Env        string
+	Passphrase string
+	Salt       string
+}
+
+func (source KeySource) IsEmpty() bool {
+	return source.File == "" && source.Env == "" && source.Passphrase == ""
+}
+
+func (source KeySource) Load() ([]byte, error) {
+	var encoded string
+
+	switch {
+	case source.File != "":
+		content, err := ioutil.ReadFile(source.File)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read master key file: %v", err)
+		}
+		encoded = string(content)
+
+	case source.Env != "":
+		encoded = os.Getenv(source.Env)
+		if encoded == "" {
+			return nil, fmt.Errorf("Environment variable %s is not set", source.Env)
+		}
+
+	case source.Passphrase != "":
+		if source.Salt == "" {
+			return nil, fmt.Errorf("A salt is required to derive the master key from a passphrase")
+		}
+
+		return scrypt.Key([]byte(source.Passphrase), []byte(source.Salt), 1<<15, 8, 1, 32)
+
+	default:
+		return nil, fmt.Errorf("No master key configured")
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("Master key is not hex encoded: %v", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Master key must be 32 bytes long, got %d", len(key))
+	}
+
+	return key, nil
+}
+
+// Keyring encrypts private keys at rest. Each private key is sealed with its
+// own random data key (AES-256-GCM, bound to its address), and the data key
+// is itself sealed with the master key identified by Version. The previous
+// master keys added to it are only used to decrypt, until every private key
+// is re-encrypted with the current one.
+type Keyring struct {
+	Version int
+	masters map[int]cipher.AEAD
+}
+
+func NewKeyring(version int, source KeySource) (*Keyring, error) {
+	keyring := &Keyring{Version: version, masters: make(map[int]cipher.AEAD)}
+
+	err := keyring.AddPrevious(version, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyring, nil
+}
+
+// AddPrevious loads another master key, to decrypt the private keys not
+// re-encrypted with the current one yet.
+func (k *Keyring) AddPrevious(version int, source KeySource) error {
+	if version <= 0 {
+		return fmt.Errorf("Master key version must be greater than 0")
+	}
+
+	if _, ok := k.masters[version]; ok {
+		return fmt.Errorf("Master key version %d is already loaded", version)
+	}
+
+	key, err := source.Load()
+	if err != nil {
+		return err
+	}
+
+	master, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	k.masters[version] = master
+
+	return nil
+}
+
+// HasVersion tells whether the master key of the given version is loaded.
+func (k *Keyring) HasVersion(version int) bool {
+	_, ok := k.masters[version]
+	return ok
+}
+
+// LoadKeyring returns the keyring configured in the [keys] section, or nil
+// if none is.
+func LoadKeyring(config *Config) (*Keyring, error) {
+	if config.MasterKey.IsEmpty() {
+		return nil, nil
+	}
+
+	keyring, err := NewKeyring(config.MasterKeyVersion, config.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if false == config.PreviousMasterKey.IsEmpty() {
+		err = keyring.AddPrevious(config.PreviousMasterKeyVersion, config.PreviousMasterKey)
+		if err != nil {
+			return nil, fmt.Errorf("Previous master key: %v", err)
+		}
+	}
+
+	return keyring, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func unseal(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("Ciphertext too short")
+	}
+
+	nonce := sealed[:aead.NonceSize()]
+
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], additional)
+}
+
+// Encrypt returns "<sealed data key>:<sealed private key>", base64 encoded.
+func (k *Keyring) Encrypt(address, private string) (string, error) {
+	additional := []byte(strings.ToLower(address))
+
+	dataKey := make([]byte, 32)
+
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealedKey, err := seal(k.masters[k.Version], dataKey, additional)
+	if err != nil {
+		return "", err
+	}
+
+	sealedPrivate, err := seal(aead, []byte(private), additional)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(sealedKey) + ":" + base64.StdEncoding.EncodeToString(sealedPrivate), nil
+}
+
+// Decrypt opens a private key encrypted with the master key of the given
+// version.
+func (k *Keyring) Decrypt(version int, address, ciphertext string) (string, error) {
+	master, ok := k.masters[version]
+	if false == ok {
+		return "", fmt.Errorf("Master key version %d is not loaded", version)
+	}
+
+	additional := []byte(strings.ToLower(address))
+
+	parts := strings.SplitN(ciphertext, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid encrypted private key format")
+	}
+
+	sealedKey, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+
+	sealedPrivate, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := unseal(master, sealedKey, additional)
+	if err != nil {
+		return "", fmt.Errorf("Could not decrypt data key: %v", err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	private, err := unseal(aead, sealedPrivate, additional)
+	if err != nil {
+		return "", fmt.Errorf("Could not decrypt private key: %v", err)
+	}
+
+	return string(private), nil
+}
+
+// RotateKeysCommand re-encrypts every private key with a new master key,
+// given on the command line, or with the configured one when none is. The
+// configured master keys, current and previous, are used to decrypt.
+func RotateKeysCommand(config *Config, db Store, args []string) error {
+	var source KeySource
+	var version int
+	var plaintext bool
+
+	flags := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	flags.StringVar(&source.File, "key-file", "", "File holding the new hex encoded master key")
+	flags.StringVar(&source.Env, "key-env", "", "Environment variable holding the new hex encoded master key")
+	flags.StringVar(&source.Passphrase, "passphrase", "", "Passphrase to derive the new master key from")
+	flags.StringVar(&source.Salt, "salt", "", "Salt used with -passphrase")
+	flags.IntVar(&version, "version", 0, "Version of the new master key")
+	flags.BoolVar(&plaintext, "plaintext", false, "Decrypt keys and store them in plaintext")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var keyring *Keyring
+
+	switch {
+	case plaintext:
+	case source.IsEmpty():
+		keyring, err = LoadKeyring(config)
+		if err != nil {
+			return err
+		}
+		if keyring == nil {
+			return fmt.Errorf("No master key configured nor given: Use -key-file, -key-env, -passphrase or -plaintext")
+		}
+	default:
+		keyring, err = NewKeyring(version, source)
+		if err != nil {
+			return err
+		}
+	}
+
+	count, err := db.RotateKeys(keyring)
+	if err != nil {
+		return fmt.Errorf("Could not rotate keys: %v", err)
+	}
+
+	log.Printf("Re-encrypted %d private keys.", count)
+	if keyring != nil && false == source.IsEmpty() {
+		log.Printf("Update the [keys] section of the configuration to use the new master key (version %d).", keyring.Version)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const TEST_MASTER_KEY = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+const TEST_PRIVATE_KEY = "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+
+func newTestKeyring(t *testing.T, version int, hexKey string) *Keyring {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "master.key")
+
+	err := ioutil.WriteFile(file, []byte(hexKey+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := NewKeyring(version, KeySource{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keyring
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	keyring := newTestKeyring(t, 1, TEST_MASTER_KEY)
+	address := "2c7536E3605D9C16a7a3D7b1898e529396a65c23"
+
+	encrypted, err := keyring.Encrypt(address, TEST_PRIVATE_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(encrypted, TEST_PRIVATE_KEY) {
+		t.Fatalf("Encrypted private key contains the private key")
+	}
+
+	// The address is compared case insensitively.
+	private, err := keyring.Decrypt(1, strings.ToLower(address), encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if private != TEST_PRIVATE_KEY {
+		t.Errorf("Decrypted %s, expected %s", private, TEST_PRIVATE_KEY)
+	}
+
+	again, err := keyring.Encrypt(address, TEST_PRIVATE_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again == encrypted {
+		t.Errorf("Encrypting twice should use different data keys and nonces")
+	}
+}
+
+func TestKeyringDecryptFailures(t *testing.T) {
+	keyring := newTestKeyring(t, 1, TEST_MASTER_KEY)
+	address := "2c7536e3605d9c16a7a3d7b1898e529396a65c23"
+
+	encrypted, err := keyring.Encrypt(address, TEST_PRIVATE_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = keyring.Decrypt(1, "85e31428748622432ab6c13d4a3a5319f0a67186", encrypted)
+	if err == nil {
+		t.Errorf("Decrypting for another address should fail")
+	}
+
+	other := newTestKeyring(t, 2, strings.Repeat("ff", 32))
+
+	_, err = other.Decrypt(2, address, encrypted)
+	if err == nil {
+		t.Errorf("Decrypting with another master key should fail")
+	}
+
+	for _, invalid := range []string{"", "no-separator", "!!!:!!!", encrypted[:10] + ":" + encrypted[len(encrypted)-10:]} {
+		_, err = keyring.Decrypt(1, address, invalid)
+		if err == nil {
+			t.Errorf("Decrypting %q should fail", invalid)
+		}
+	}
+}
+
+func TestKeyringPrevious(t *testing.T) {
+	previous := newTestKeyring(t, 1, TEST_MASTER_KEY)
+	address := "2c7536e3605d9c16a7a3d7b1898e529396a65c23"
+
+	encrypted, err := previous.Encrypt(address, TEST_PRIVATE_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := newTestKeyring(t, 2, strings.Repeat("ff", 32))
+
+	file := filepath.Join(t.TempDir(), "previous.key")
+	err = ioutil.WriteFile(file, []byte(TEST_MASTER_KEY), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = keyring.AddPrevious(1, KeySource{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private, err := keyring.Decrypt(1, address, encrypted)
+	if err != nil || private != TEST_PRIVATE_KEY {
+		t.Fatalf("Decrypt with the previous master key returned %q, %v", private, err)
+	}
+
+	// New keys are encrypted with the current master key.
+	encrypted, err = keyring.Encrypt(address, TEST_PRIVATE_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = keyring.Decrypt(1, address, encrypted); err == nil {
+		t.Errorf("Key encrypted with the current master key should not open with the previous one")
+	}
+
+	if err = keyring.AddPrevious(2, KeySource{File: file}); err == nil {
+		t.Errorf("Adding a loaded version again should fail")
+	}
+}
+
+func TestKeySourceLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"hex key", TEST_MASTER_KEY, true},
+		{"hex key with spaces", "  " + TEST_MASTER_KEY + "\n", true},
+		{"not hex", strings.Repeat("zz", 32), false},
+		{"too short", TEST_MASTER_KEY[:32], false},
+	}
+
+	for _, test := range tests {
+		file := filepath.Join(dir, strings.ReplaceAll(test.name, " ", "_"))
+
+		err := ioutil.WriteFile(file, []byte(test.content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := KeySource{File: file}.Load()
+		if test.valid && (err != nil || len(key) != 32) {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if false == test.valid && err == nil {
+			t.Errorf("%s: should fail", test.name)
+		}
+	}
+
+	_, err := KeySource{Passphrase: "secret"}.Load()
+	if err == nil {
+		t.Errorf("A passphrase without salt should fail")
+	}
+
+	_, err = NewKeyring(0, KeySource{File: filepath.Join(dir, "hex_key")})
+	if err == nil {
+		t.Errorf("Master key version 0 should be refused")
+	}
+}
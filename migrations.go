@@ -0,0 +1,253 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations are stored in migrations/<dialect>/NNNN_name.(up|down).sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied bool
+}
+
+func LoadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("No migrations for dialect %s: %v", dialect, err)
+	}
+
+	byVersion := make(map[int]*Migration)
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimSuffix(name, "."+direction+".sql"), "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid migration file name %s", name)
+		}
+
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid migration file name %s: %v", name, err)
+		}
+
+		content, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if false == ok {
+			migration = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = migration
+		}
+
+		if direction == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// SplitStatements splits a migration file into its SQL statements.
+func SplitStatements(content string) []string {
+	var lines []string
+
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	statements := make([]string, 0)
+
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		statement = strings.TrimSpace(statement)
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+
+	return statements
+}
+
+func GetMigrationStatus(db Store) ([]MigrationStatus, error) {
+	migrations, err := db.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := db.AppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		status = append(status, MigrationStatus{migration, applied[migration.Version]})
+	}
+
+	return status, nil
+}
+
+func MigrateUp(db Store) error {
+	status, err := GetMigrationStatus(db)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range status {
+		if migration.Applied {
+			continue
+		}
+
+		log.Printf("Applying migration %04d_%s", migration.Version, migration.Name)
+
+		err = db.ApplyMigration(migration.Migration, true)
+		if err != nil {
+			return fmt.Errorf("Migration %04d_%s failed: %v", migration.Version, migration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// MigrateDown reverts the last applied migration.
+func MigrateDown(db Store) error {
+	status, err := GetMigrationStatus(db)
+	if err != nil {
+		return err
+	}
+
+	for i := len(status) - 1; i >= 0; i-- {
+		migration := status[i]
+		if false == migration.Applied {
+			continue
+		}
+
+		log.Printf("Reverting migration %04d_%s", migration.Version, migration.Name)
+
+		err = db.ApplyMigration(migration.Migration, false)
+		if err != nil {
+			return fmt.Errorf("Migration %04d_%s failed: %v", migration.Version, migration.Name, err)
+		}
+
+		return nil
+	}
+
+	log.Println("No migration to revert.")
+
+	return nil
+}
+
+// CheckSchema returns an error unless every known migration, and only them,
+// were applied.
+func CheckSchema(db Store) error {
+	status, err := GetMigrationStatus(db)
+	if err != nil {
+		return err
+	}
+
+	applied, err := db.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range status {
+		if false == migration.Applied {
+			return fmt.Errorf("Database schema is out of date: migration %04d_%s is not applied; run 'eth-watcher migrate up'",
+				migration.Version, migration.Name)
+		}
+
+		delete(applied, migration.Version)
+	}
+
+	for version := range applied {
+		return fmt.Errorf("Database schema is more recent than eth-watcher: unknown migration %04d applied", version)
+	}
+
+	return nil
+}
+
+func MigrateCommand(db Store, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: eth-watcher migrate up|down|status")
+	}
+
+	switch args[0] {
+	case "up":
+		err := MigrateUp(db)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Database schema is up to date.")
+
+	case "down":
+		return MigrateDown(db)
+
+	case "status":
+		status, err := GetMigrationStatus(db)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range status {
+			state := "pending"
+			if migration.Applied {
+				state = "applied"
+			}
+
+			fmt.Printf("%04d_%-40s %s\n", migration.Version, migration.Name, state)
+		}
+
+	default:
+		return fmt.Errorf("Unknown migrate command '%s': Usage: eth-watcher migrate up|down|status", args[0])
+	}
+
+	return nil
+}
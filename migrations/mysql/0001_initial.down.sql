@@ -0,0 +1,3 @@
+DROP TABLE settings;
+DROP TABLE notifications;
+DROP TABLE eth_keys;
@@ -0,0 +1,11 @@
+DROP INDEX notifications_state_idx ON notifications;
+
+ALTER TABLE notifications DROP COLUMN effective_gas_price;
+ALTER TABLE notifications DROP COLUMN gas_used;
+ALTER TABLE notifications DROP COLUMN status;
+ALTER TABLE notifications DROP COLUMN state;
+ALTER TABLE notifications DROP COLUMN required_confirmations;
+ALTER TABLE notifications DROP COLUMN confirmations;
+ALTER TABLE notifications DROP COLUMN block_hash;
+ALTER TABLE notifications DROP COLUMN block_number;
+ALTER TABLE notifications DROP COLUMN log_index;
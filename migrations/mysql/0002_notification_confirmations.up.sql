@@ -0,0 +1,14 @@
+ALTER TABLE notifications ADD COLUMN log_index INT NOT NULL DEFAULT -1;
+ALTER TABLE notifications ADD COLUMN block_number BIGINT UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE notifications ADD COLUMN block_hash VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE notifications ADD COLUMN confirmations INT UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE notifications ADD COLUMN required_confirmations INT UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE notifications ADD COLUMN state VARCHAR(16) NOT NULL DEFAULT 'pending';
+ALTER TABLE notifications ADD COLUMN status VARCHAR(8) NOT NULL DEFAULT '';
+ALTER TABLE notifications ADD COLUMN gas_used BIGINT UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE notifications ADD COLUMN effective_gas_price VARCHAR(32) NOT NULL DEFAULT '';
+
+CREATE INDEX notifications_state_idx ON notifications(state);
+
+-- Notifications recorded before confirmations were tracked have no block.
+UPDATE notifications SET state = 'final' WHERE is_pending = false;
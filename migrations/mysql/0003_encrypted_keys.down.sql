@@ -0,0 +1,3 @@
+-- Encrypted keys must be decrypted (rotate-keys without master key) first.
+ALTER TABLE eth_keys DROP COLUMN key_version;
+ALTER TABLE eth_keys MODIFY private VARCHAR(64);
@@ -0,0 +1,2 @@
+ALTER TABLE eth_keys MODIFY private VARCHAR(255);
+ALTER TABLE eth_keys ADD COLUMN key_version INT NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+CREATE TABLE nonces(
+    address    VARCHAR(40) NOT NULL,
+    nonce      BIGINT UNSIGNED NOT NULL,
+    status     VARCHAR(16) NOT NULL,
+    updated_at BIGINT NOT NULL,
+    PRIMARY KEY (address, nonce)
+);
@@ -0,0 +1,27 @@
+CREATE TABLE transactions(
+    id                       INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    tx_hash                  VARCHAR(64) NOT NULL UNIQUE,
+    address_from             VARCHAR(40) NOT NULL,
+    address_to               VARCHAR(40) NOT NULL,
+    address_contract         VARCHAR(40) NOT NULL DEFAULT '',
+    amount                   VARCHAR(80) NOT NULL,
+    nonce                    BIGINT UNSIGNED NOT NULL,
+    gas_limit                BIGINT UNSIGNED NOT NULL,
+    gas_price                VARCHAR(32) NOT NULL DEFAULT '',
+    max_fee_per_gas          VARCHAR(32) NOT NULL DEFAULT '',
+    max_priority_fee_per_gas VARCHAR(32) NOT NULL DEFAULT '',
+    raw_tx                   TEXT NOT NULL,
+    status                   VARCHAR(16) NOT NULL DEFAULT 'pending',
+    block_number             BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    block_hash               VARCHAR(64) NOT NULL DEFAULT '',
+    confirmations            INT UNSIGNED NOT NULL DEFAULT 0,
+    gas_used                 BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    effective_gas_price      VARCHAR(32) NOT NULL DEFAULT '',
+    created_at               DATETIME DEFAULT NOW(),
+    updated_at               BIGINT NOT NULL
+);
+
+CREATE INDEX transactions_status_idx ON transactions(status);
+
+-- Notifications are either deposits (1) or outgoing transactions status changes (4).
+ALTER TABLE notifications ADD COLUMN message_type INT UNSIGNED NOT NULL DEFAULT 1;
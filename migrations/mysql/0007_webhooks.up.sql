@@ -0,0 +1,24 @@
+-- Webhooks notifications are POSTed to (address is empty for all of them),
+-- and the queue of their deliveries.
+CREATE TABLE webhooks(
+    id          VARCHAR(32) NOT NULL PRIMARY KEY,
+    url         TEXT NOT NULL,
+    address     VARCHAR(40) NOT NULL DEFAULT '',
+    secret      VARCHAR(128) NOT NULL,
+    created_at  DATETIME DEFAULT NOW()
+);
+
+CREATE TABLE webhook_deliveries(
+    id               INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    webhook_id       VARCHAR(32) NOT NULL,
+    payload          TEXT NOT NULL,
+    status           VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts         INT UNSIGNED NOT NULL DEFAULT 0,
+    next_attempt_at  BIGINT NOT NULL,
+    last_error       TEXT NOT NULL,
+    created_at       DATETIME DEFAULT NOW(),
+    updated_at       BIGINT NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_status_idx ON webhook_deliveries(status, next_attempt_at);
+CREATE INDEX webhook_deliveries_webhook_idx ON webhook_deliveries(webhook_id);
@@ -0,0 +1,3 @@
+-- Deleted duplicates are not restored.
+DROP INDEX notifications_unique_idx ON notifications;
+ALTER TABLE notifications DROP COLUMN is_current;
@@ -0,0 +1,20 @@
+-- Set on the notifications of transfers which are not orphaned: a transfer
+-- is recorded once pending and once mined. NULL rows are left out of the
+-- unique key.
+ALTER TABLE notifications ADD COLUMN is_current BOOLEAN NULL;
+
+-- Pending notifications of mined transfers.
+DELETE p FROM notifications p
+    JOIN notifications m ON m.tx_hash = p.tx_hash AND m.address_to = p.address_to
+        AND m.message_type = 1 AND m.is_pending = false AND m.state NOT IN ('orphaned', 'reverted')
+    WHERE p.message_type = 1 AND p.is_pending = true;
+
+-- Duplicates, the first one recorded is kept.
+DELETE d FROM notifications d
+    JOIN notifications k ON k.tx_hash = d.tx_hash AND k.log_index = d.log_index AND k.address_to = d.address_to
+        AND k.is_pending = d.is_pending AND k.message_type = 1 AND k.state NOT IN ('orphaned', 'reverted') AND k.id < d.id
+    WHERE d.message_type = 1 AND d.state NOT IN ('orphaned', 'reverted');
+
+UPDATE notifications SET is_current = true WHERE message_type = 1 AND state NOT IN ('orphaned', 'reverted');
+
+CREATE UNIQUE INDEX notifications_unique_idx ON notifications(tx_hash, log_index, address_to, is_pending, is_current);
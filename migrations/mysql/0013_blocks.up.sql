@@ -0,0 +1,6 @@
+-- Hashes of the last processed blocks, to detect a reorganisation of the
+-- chain which happened while eth-watcher was stopped.
+CREATE TABLE blocks(
+    number  BIGINT UNSIGNED NOT NULL PRIMARY KEY,
+    hash    VARCHAR(64) NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE eth_keys ALTER COLUMN private TYPE VARCHAR(255);
+ALTER TABLE eth_keys ADD COLUMN key_version INT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- Notifications were only recorded for transfers to watched addresses.
+ALTER TABLE notifications ADD COLUMN direction VARCHAR(8) NOT NULL DEFAULT 'in';
+UPDATE notifications SET direction = 'out' WHERE message_type = 4;
@@ -0,0 +1,3 @@
+-- Deleted duplicates are not restored.
+DROP INDEX notifications_unique_idx;
+ALTER TABLE notifications DROP COLUMN is_current;
@@ -0,0 +1,25 @@
+-- Set on the notifications of transfers which are not orphaned: a transfer
+-- is recorded once pending and once mined. NULL rows are left out of the
+-- unique key.
+ALTER TABLE notifications ADD COLUMN is_current BOOLEAN;
+
+-- Pending notifications of mined transfers.
+DELETE FROM notifications
+    WHERE message_type = 1 AND is_pending = true AND EXISTS (
+        SELECT 1 FROM notifications m
+        WHERE m.tx_hash = notifications.tx_hash AND m.address_to = notifications.address_to
+            AND m.message_type = 1 AND m.is_pending = false AND m.state NOT IN ('orphaned', 'reverted')
+    );
+
+-- Duplicates, the first one recorded is kept.
+DELETE FROM notifications
+    WHERE message_type = 1 AND state NOT IN ('orphaned', 'reverted') AND EXISTS (
+        SELECT 1 FROM notifications k
+        WHERE k.tx_hash = notifications.tx_hash AND k.log_index = notifications.log_index
+            AND k.address_to = notifications.address_to AND k.is_pending = notifications.is_pending
+            AND k.message_type = 1 AND k.state NOT IN ('orphaned', 'reverted') AND k.id < notifications.id
+    );
+
+UPDATE notifications SET is_current = true WHERE message_type = 1 AND state NOT IN ('orphaned', 'reverted');
+
+CREATE UNIQUE INDEX notifications_unique_idx ON notifications(tx_hash, log_index, address_to, is_pending, is_current);
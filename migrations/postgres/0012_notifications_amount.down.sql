@@ -0,0 +1,2 @@
+-- Fails while an amount longer than 32 digits is recorded.
+ALTER TABLE notifications ALTER COLUMN amount TYPE VARCHAR(32);
@@ -0,0 +1,2 @@
+-- Token amounts are uint256: up to 78 digits, as transactions.amount.
+ALTER TABLE notifications ALTER COLUMN amount TYPE VARCHAR(80);
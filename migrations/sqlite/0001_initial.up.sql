@@ -0,0 +1,24 @@
+CREATE TABLE eth_keys(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    address VARCHAR(40) UNIQUE,
+    private VARCHAR(64)
+);
+
+CREATE INDEX eth_keys_address_idx ON eth_keys(address);
+
+CREATE TABLE notifications(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    address_from     VARCHAR(40),
+    address_to       VARCHAR(40),
+    address_contract VARCHAR(40),
+    amount           VARCHAR(32),
+    is_pending       BOOLEAN NOT NULL DEFAULT false,
+    tx_hash          VARCHAR(64),
+    created_at       DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE settings(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(32) UNIQUE,
+    value VARCHAR(64)
+);
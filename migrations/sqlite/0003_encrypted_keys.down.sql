@@ -0,0 +1,2 @@
+-- Encrypted keys must be decrypted (rotate-keys without master key) first.
+ALTER TABLE eth_keys DROP COLUMN key_version;
@@ -0,0 +1,2 @@
+-- SQLite does not enforce VARCHAR lengths: private can hold ciphertexts as is.
+ALTER TABLE eth_keys ADD COLUMN key_version INTEGER NOT NULL DEFAULT 0;
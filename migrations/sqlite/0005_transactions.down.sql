@@ -0,0 +1,3 @@
+ALTER TABLE notifications DROP COLUMN message_type;
+
+DROP TABLE transactions;
@@ -0,0 +1,4 @@
+ALTER TABLE transactions DROP COLUMN broadcast_block;
+ALTER TABLE transactions DROP COLUMN replacements;
+ALTER TABLE transactions DROP COLUMN replaced_by;
+ALTER TABLE transactions DROP COLUMN replaces;
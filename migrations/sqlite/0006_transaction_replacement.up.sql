@@ -0,0 +1,6 @@
+-- Speed-up and cancellation: a replacement transaction re-uses the nonce of
+-- the transaction it replaces, with higher fees.
+ALTER TABLE transactions ADD COLUMN replaces VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE transactions ADD COLUMN replaced_by VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE transactions ADD COLUMN replacements INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN broadcast_block INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+DROP INDEX notifications_recorded_at_idx;
+ALTER TABLE notifications DROP COLUMN recorded_at;
+
+DROP TABLE consumers;
@@ -0,0 +1,11 @@
+-- Named consumers of /getNotifications and the last notification id each
+-- one acknowledged. Notifications are only pruned once acknowledged by all.
+CREATE TABLE consumers(
+    name        VARCHAR(64) NOT NULL PRIMARY KEY,
+    acked_id    INTEGER NOT NULL DEFAULT 0,
+    updated_at  BIGINT NOT NULL
+);
+
+-- Unix time the notification was recorded at, for the retention policy.
+ALTER TABLE notifications ADD COLUMN recorded_at BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX notifications_recorded_at_idx ON notifications(recorded_at);
@@ -0,0 +1 @@
+DROP INDEX notifications_tx_hash_idx;
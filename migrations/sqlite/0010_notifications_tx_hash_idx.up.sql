@@ -0,0 +1,2 @@
+-- Looked up before recording a notification, so blocks can be re-scanned.
+CREATE INDEX notifications_tx_hash_idx ON notifications(tx_hash);
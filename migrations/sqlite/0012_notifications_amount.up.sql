@@ -0,0 +1 @@
+-- SQLite does not enforce the length of VARCHAR columns: nothing to widen.
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	// Health checks and calls a node's error rate is computed on.
+	NODE_HEALTH_WINDOW = 20
+
+	// Healthy checks in a row before failing back to a node with a lower
+	// priority than the one in use.
+	NODE_FAILBACK_CHECKS = 3
+)
+
+// Node is an upstream node, and the result of its last health checks.
+type Node struct {
+	NodeConfig
+	client *ethclient.Client
+
+	head      uint64
+	latency   time.Duration
+	failures  []bool
+	lastError string
+	checkedAt time.Time
+	healthy   bool
+
+	// Healthy checks in a row.
+	healthyChecks int
+}
+
+func (n *Node) record(failed bool) {
+	n.failures = append(n.failures, failed)
+	if len(n.failures) > NODE_HEALTH_WINDOW {
+		n.failures = n.failures[1:]
+	}
+}
+
+func (n *Node) errorRate() float64 {
+	if len(n.failures) == 0 {
+		return 0
+	}
+
+	failed := 0
+	for _, failure := range n.failures {
+		if failure {
+			failed++
+		}
+	}
+
+	return float64(failed) / float64(len(n.failures))
+}
+
+// NodeStatus is the state of a node, as returned by /getNodes.
+type NodeStatus struct {
+	Name         string
+	RPCURL       string
+	WebsocketURL string
+	Priority     int
+	Active       bool
+	Healthy      bool
+	Head         uint64
+	Lag          uint64
+	LatencyMs    int64
+	ErrorRate    float64
+	LastError    string
+	CheckedAt    int64
+}
+
+// NodePool selects the node in use: the healthy node with the lowest
+// priority. Nodes are considered healthy until checked.
+type NodePool struct {
+	mu      sync.Mutex
+	nodes   []*Node
+	active  *Node
+	changed chan struct{}
+}
+
+func NewNodePool(configs []NodeConfig) (*NodePool, error) {
+	pool := &NodePool{changed: make(chan struct{})}
+
+	for _, config := range configs {
+		client, err := ethclient.Dial(fmt.Sprintf("http://%s", config.RPCURL))
+		if err != nil {
+			return nil, fmt.Errorf("Could not connect to node '%s': %v", config.Name, err)
+		}
+
+		pool.nodes = append(pool.nodes, &Node{NodeConfig: config, client: client, healthy: true})
+	}
+
+	pool.active = pool.nodes[0]
+
+	return pool, nil
+}
+
+// OpenNodePool connects to the configured nodes, and starts on the healthy
+// node with the lowest priority. Only the commands calling nodes open it.
+func OpenNodePool(config *Config) (*NodePool, error) {
+	pool, err := NewNodePool(config.Nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.Check(config)
+
+	return pool, nil
+}
+
+// Active returns the node in use, and a channel closed once another node is
+// selected.
+func (p *NodePool) Active() (*Node, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.active, p.changed
+}
+
+// Client returns the shared RPC client of the node in use. It must not be
+// closed.
+func (p *NodePool) Client() *ethclient.Client {
+	node, _ := p.Active()
+	return node.client
+}
+
+// Report records the outcome of a call to the node of the given client in
+// its error rate: only a node which could not be reached, did not answer in
+// time, or could not serve the data asked for, failed. Node calls give their
+// kind to the errors they return (see NodeError).
+func (p *NodePool) Report(client *ethclient.Client, err error) {
+	failed := errors.Is(err, ErrNodeUnavailable) || errors.Is(err, ErrNodeTimeout)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, node := range p.nodes {
+		if node.client == client {
+			node.record(failed)
+			return
+		}
+	}
+}
+
+// Check runs a health check of every node, and fails over to another node
+// if the active one is unhealthy, or back to a node with a lower priority
+// once it passed NODE_FAILBACK_CHECKS checks in a row.
+func (p *NodePool) Check(config *Config) {
+	type result struct {
+		head    uint64
+		latency time.Duration
+		err     error
+	}
+
+	results := make([]result, len(p.nodes))
+
+	var wg sync.WaitGroup
+	for i, node := range p.nodes {
+		wg.Add(1)
+
+		go func(i int, node *Node) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), config.NodeMaxLatency)
+			defer cancel()
+
+			start := time.Now()
+			head, err := node.client.BlockNumber(ctx)
+			results[i] = result{head, time.Since(start), err}
+		}(i, node)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best uint64
+	for _, res := range results {
+		if res.err == nil && res.head > best {
+			best = res.head
+		}
+	}
+
+	for i, node := range p.nodes {
+		res := results[i]
+
+		node.checkedAt = time.Now()
+		node.latency = res.latency
+		node.record(res.err != nil)
+
+		switch {
+		case res.err != nil:
+			node.lastError = res.err.Error()
+		case best-res.head > config.NodeMaxHeadLag:
+			node.head = res.head
+			node.lastError = fmt.Sprintf("Head is %d blocks behind", best-res.head)
+		default:
+			node.head = res.head
+			node.lastError = ""
+		}
+
+		if node.lastError == "" && node.errorRate() > config.NodeMaxErrorRate {
+			node.lastError = fmt.Sprintf("%.0f%% of the last health checks and calls failed", node.errorRate()*100)
+		}
+
+		healthy := node.lastError == ""
+		if healthy {
+			node.healthyChecks++
+		} else {
+			node.healthyChecks = 0
+		}
+
+		if healthy && false == node.healthy {
+			log.Printf("Nodes: Node '%s' is healthy again", node.Name)
+		} else if false == healthy && node.healthy {
+			log.Printf("Nodes: Node '%s' is unhealthy: %s", node.Name, node.lastError)
+		}
+		node.healthy = healthy
+	}
+
+	for _, node := range p.nodes {
+		if false == node.healthy {
+			continue
+		}
+
+		// Don't fail back to a node which only just recovered: it may
+		// still be flapping.
+		if node != p.active && p.active.healthy && node.healthyChecks < NODE_FAILBACK_CHECKS {
+			continue
+		}
+
+		if node != p.active {
+			log.Printf("Nodes: Switching from node '%s' to node '%s'", p.active.Name, node.Name)
+
+			p.active = node
+			close(p.changed)
+			p.changed = make(chan struct{})
+		}
+
+		return
+	}
+
+	log.Printf("Nodes: No healthy node: Still using node '%s'", p.active.Name)
+}
+
+func (p *NodePool) Status() []NodeStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best uint64
+	for _, node := range p.nodes {
+		if node.head > best {
+			best = node.head
+		}
+	}
+
+	statuses := make([]NodeStatus, 0, len(p.nodes))
+
+	for _, node := range p.nodes {
+		status := NodeStatus{
+			Name:         node.Name,
+			RPCURL:       node.RPCURL,
+			WebsocketURL: node.WebsocketURL,
+			Priority:     node.Priority,
+			Active:       node == p.active,
+			Healthy:      node.healthy,
+			Head:         node.head,
+			Lag:          best - node.head,
+			LatencyMs:    node.latency.Milliseconds(),
+			ErrorRate:    node.errorRate(),
+			LastError:    node.lastError,
+		}
+
+		if false == node.checkedAt.IsZero() {
+			status.CheckedAt = node.checkedAt.Unix()
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// NodeHealthChecker checks the nodes periodically.
+func NodeHealthChecker(config *Config, pool *NodePool) {
+	for {
+		time.Sleep(config.NodeCheckInterval)
+		pool.Check(config)
+	}
+}
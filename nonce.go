@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	NONCE_RESERVED = "reserved"
+	NONCE_USED     = "used"
+	NONCE_RELEASED = "released"
+
+	// A reservation never confirmed nor released (crash during broadcast)
+	// is reclaimed after this delay.
+	NONCE_RESERVATION_TIMEOUT = 10 * time.Minute
+)
+
+type NonceReservation struct {
+	Nonce     uint64
+	Status    string
+	UpdatedAt time.Time
+}
+
+// NonceManager allocates the nonces of outgoing transactions, one address at
+// a time, so concurrent sends from an address never share a nonce.
+// Reservations are persisted so they survive restarts and are shared by
+// every send path.
+type NonceManager struct {
+	db    Store
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func NewNonceManager(db Store) *NonceManager {
+	return &NonceManager{
+		db:    db,
+		locks: make(map[string]*sync.Mutex),
+	}
+}
+
+func nonceAddress(address common.Address) string {
+	return strings.ToLower(address.Hex()[2:])
+}
+
+func (m *NonceManager) lock(address string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, ok := m.locks[address]
+	if false == ok {
+		l = new(sync.Mutex)
+		m.locks[address] = l
+	}
+
+	return l
+}
+
+// Allocate reserves the next nonce for the given address: the lowest nonce
+// at or above the node's pending nonce which is not already in use, so the
+// nonce of a failed broadcast is reused first.
+func (m *NonceManager) Allocate(ctx context.Context, client *ethclient.Client, address common.Address) (uint64, error) {
+	key := nonceAddress(address)
+
+	l := m.lock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	pending, err := client.PendingNonceAt(ctx, address)
+	if err != nil {
+		return 0, fmt.Errorf("Could not retrieve pending nonce: %w", NodeError(err))
+	}
+
+	// The node accounts for everything below its pending nonce.
+	err = m.db.PruneNonces(key, pending)
+	if err != nil {
+		return 0, err
+	}
+
+	reservations, err := m.db.GetNonces(key)
+	if err != nil {
+		return 0, err
+	}
+
+	nonce := pending
+	for {
+		reservation, ok := reservations[nonce]
+		if false == ok || reservation.Status == NONCE_RELEASED {
+			break
+		}
+
+		if reservation.Status == NONCE_RESERVED && time.Since(reservation.UpdatedAt) > NONCE_RESERVATION_TIMEOUT {
+			log.Printf("NonceManager: Reclaiming stale reservation of nonce %d for %s", nonce, key)
+			break
+		}
+
+		nonce++
+	}
+
+	err = m.db.SetNonce(key, nonce, NONCE_RESERVED)
+	if err != nil {
+		return 0, err
+	}
+
+	return nonce, nil
+}
+
+// Release gives back a nonce whose transaction could not be broadcast, or
+// was dropped by the node.
+func (m *NonceManager) Release(address common.Address, nonce uint64) {
+	err := m.db.SetNonce(nonceAddress(address), nonce, NONCE_RELEASED)
+	if err != nil {
+		log.Printf("NonceManager: Could not release nonce %d of %s: %v", nonce, address.Hex(), err)
+	}
+}
+
+// Confirm marks a nonce as used by a broadcast transaction.
+func (m *NonceManager) Confirm(address common.Address, nonce uint64) {
+	err := m.db.SetNonce(nonceAddress(address), nonce, NONCE_USED)
+	if err != nil {
+		log.Printf("NonceManager: Could not confirm nonce %d of %s: %v", nonce, address.Hex(), err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// Notifications returned by /getNotifications by default, and at most.
+	DEFAULT_NOTIFICATIONS_LIMIT = 100
+	MAX_NOTIFICATIONS_LIMIT     = 1000
+
+	NOTIFICATIONS_PRUNE_INTERVAL = time.Hour
+)
+
+// Consumer is a named reader of notifications, and the id of the last
+// notification it acknowledged.
+type Consumer struct {
+	Name      string
+	AckedID   uint64
+	UpdatedAt int64
+}
+
+// NotificationJanitor deletes the notifications older than the configured
+// retention once every consumer acknowledged them, and the consumers idle
+// for longer than the configured expiry.
+func NotificationJanitor(config *Config, db Store) {
+	if config.NotificationRetention == 0 && config.ConsumerExpiry == 0 {
+		return
+	}
+
+	for {
+		if config.ConsumerExpiry != 0 {
+			names, err := db.PruneConsumers(time.Now().Add(-config.ConsumerExpiry).Unix())
+			if err != nil {
+				log.Println("NotificationJanitor:", err)
+			}
+
+			for _, name := range names {
+				log.Printf("NotificationJanitor: Removed consumer %s: Nothing acknowledged for %v", name, config.ConsumerExpiry)
+			}
+		}
+
+		if config.NotificationRetention != 0 {
+			count, err := db.PruneNotifications(time.Now().Add(-config.NotificationRetention).Unix())
+			if err != nil {
+				log.Println("NotificationJanitor:", err)
+			} else if count > 0 {
+				log.Printf("NotificationJanitor: Deleted %d notifications", count)
+			}
+		}
+
+		time.Sleep(NOTIFICATIONS_PRUNE_INTERVAL)
+	}
+}
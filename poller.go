@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// Delay before installing again a pending transactions filter which could
+// not be installed.
+const PENDING_FILTER_RETRY_INTERVAL = time.Minute
+
+// newPendingFilter installs a pending transactions filter, returning "" if
+// the node does not support them: only mined transactions are notified then.
+func newPendingFilter(ctx context.Context, client *ethclient.Client) string {
+	var filter string
+
+	err := client.Client().CallContext(ctx, &filter, "eth_newPendingTransactionFilter")
+	if err != nil {
+		log.Printf("PollRPC: Could not install pending transactions filter: %v", err)
+		return ""
+	}
+
+	return filter
+}
+
+// PollRPC feeds ch with the new heads and pending transactions polled from
+// the RPC API of a node, for nodes without a WebSocket API. Heads mined
+// between two polls are processed by Listener from the next one. It returns
+// when the context is done, or on error.
+func PollRPC(ctx context.Context, config *Config, node *Node, ch chan<- ObjMessage) error {
+	log.Printf("Polling Ethereum RPC API of node '%s' every %v", node.Name, config.PollInterval)
+
+	client := node.client
+
+	filter := newPendingFilter(ctx, client)
+	filterInstalledAt := time.Now()
+	defer func() {
+		if filter != "" {
+			client.Client().Call(nil, "eth_uninstallFilter", filter)
+		}
+	}()
+
+	var head uint64
+
+	for {
+		number, err := client.BlockNumber(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("PollRPC: Could not retrieve latest block number: %v", err)
+		}
+
+		if number != head {
+			var header BlockHeader
+
+			err = client.Client().CallContext(ctx, &header, "eth_getBlockByNumber", hexutil.EncodeUint64(number), false)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+
+				return fmt.Errorf("PollRPC: Could not retrieve block %d: %v", number, err)
+			}
+
+			// Unknown yet to the node behind a load balancer: retried at
+			// the next poll.
+			if header.Hash != "" {
+				ch <- ObjMessage{TYPE_BLOCK_HASH, header.Hash, new(big.Int).SetUint64(number)}
+				head = number
+			}
+		}
+
+		// The filter could not be installed (node restarting, behind a
+		// load balancer...): it is installed again from time to time.
+		if filter == "" && time.Since(filterInstalledAt) >= PENDING_FILTER_RETRY_INTERVAL {
+			filter = newPendingFilter(ctx, client)
+			filterInstalledAt = time.Now()
+		}
+
+		if filter != "" {
+			var hashes []string
+
+			err = client.Client().CallContext(ctx, &hashes, "eth_getFilterChanges", filter)
+			if err != nil && ctx.Err() == nil {
+				// Filters not polled for a while are removed by the node.
+				log.Printf("PollRPC: Could not read pending transactions filter: %v: Installing a new one", err)
+				filter = newPendingFilter(ctx, client)
+				filterInstalledAt = time.Now()
+			}
+
+			for _, hash := range hashes {
+				ch <- ObjMessage{TYPE_TXN_HASH, hash, nil}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(config.PollInterval):
+		}
+	}
+}
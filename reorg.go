@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Number of recent block hashes kept to detect chain reorganisations.
+const BLOCK_WINDOW_SIZE = 128
+
+// ErrReorgTooDeep is returned when none of the blocks of the window is in
+// the canonical chain any longer.
+var ErrReorgTooDeep = errors.New("No common ancestor found")
+
+// HeaderReader reads the canonical headers known by a node; implemented by
+// *ethclient.Client.
+type HeaderReader interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// BlockWindow keeps the hashes of the last processed blocks, by number.
+type BlockWindow struct {
+	size   uint64
+	head   uint64
+	hashes map[uint64]common.Hash
+}
+
+func NewBlockWindow(size uint64) *BlockWindow {
+	return &BlockWindow{
+		size:   size,
+		hashes: make(map[uint64]common.Hash),
+	}
+}
+
+// LoadBlockWindow rebuilds the window from the hashes of the blocks
+// processed before a restart.
+func LoadBlockWindow(db Store) (*BlockWindow, error) {
+	blocks, err := db.GetBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := make([]uint64, 0, len(blocks))
+	for number := range blocks {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	window := NewBlockWindow(BLOCK_WINDOW_SIZE)
+	for _, number := range numbers {
+		window.Add(number, common.HexToHash(blocks[number]))
+	}
+
+	return window, nil
+}
+
+func (w *BlockWindow) Add(number uint64, hash common.Hash) {
+	w.hashes[number] = hash
+	w.head = number
+
+	for n := range w.hashes {
+		if n+w.size <= number {
+			delete(w.hashes, n)
+		}
+	}
+}
+
+func (w *BlockWindow) Get(number uint64) (common.Hash, bool) {
+	hash, ok := w.hashes[number]
+	return hash, ok
+}
+
+func (w *BlockWindow) IsEmpty() bool {
+	return len(w.hashes) == 0
+}
+
+// Reset forgets every block.
+func (w *BlockWindow) Reset() {
+	w.hashes = make(map[uint64]common.Hash)
+	w.head = 0
+}
+
+// Truncate forgets every block above number.
+func (w *BlockWindow) Truncate(number uint64) {
+	for n := range w.hashes {
+		if n > number {
+			delete(w.hashes, n)
+		}
+	}
+
+	w.head = number
+}
+
+// IsReorg tells whether the given block does not extend the chain we
+// processed so far.
+func (w *BlockWindow) IsReorg(block *types.Block) bool {
+	if w.IsEmpty() {
+		return false
+	}
+
+	number := block.NumberU64()
+
+	if number <= w.head {
+		return true
+	}
+
+	parent, ok := w.Get(number - 1)
+	if ok && parent != block.ParentHash() {
+		return true
+	}
+
+	return false
+}
+
+// FindCommonAncestor walks back from the given number until the canonical
+// block known by the node matches the one we processed. A header which can't
+// be read fails with a node error: the walk can be tried again.
+func (w *BlockWindow) FindCommonAncestor(ctx context.Context, client HeaderReader, number uint64) (uint64, error) {
+	if number > w.head {
+		number = w.head
+	}
+
+	for {
+		hash, ok := w.Get(number)
+		if false == ok {
+			return 0, fmt.Errorf("%w: Reorg deeper than %d blocks", ErrReorgTooDeep, w.size)
+		}
+
+		header, err := client.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+		if err != nil {
+			return 0, fmt.Errorf("FindCommonAncestor: %w", NodeError(err))
+		}
+
+		if header.Hash() == hash {
+			return number, nil
+		}
+
+		if number == 0 {
+			return 0, fmt.Errorf("%w: Reached genesis block", ErrReorgTooDeep)
+		}
+
+		number--
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// fakeChain is a HeaderReader serving the headers of a chain whose blocks
+// are tagged by branch.
+type fakeChain map[uint64]*types.Header
+
+func (c fakeChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	header, ok := c[number.Uint64()]
+	if false == ok {
+		return nil, fmt.Errorf("Block %d not found", number.Uint64())
+	}
+
+	return header, nil
+}
+
+func newFakeChain(from, to uint64, branch string) fakeChain {
+	chain := make(fakeChain)
+	chain.extend(from, to, branch)
+
+	return chain
+}
+
+// extend replaces the blocks from "from" to "to" with the ones of a branch.
+func (c fakeChain) extend(from, to uint64, branch string) {
+	for number := from; number <= to; number++ {
+		header := &types.Header{
+			Number: new(big.Int).SetUint64(number),
+			Extra:  []byte(branch),
+		}
+
+		if parent, ok := c[number-1]; ok {
+			header.ParentHash = parent.Hash()
+		}
+
+		c[number] = header
+	}
+}
+
+func (c fakeChain) block(number uint64) *types.Block {
+	return types.NewBlockWithHeader(c[number])
+}
+
+func windowOf(chain fakeChain, from, to uint64, size uint64) *BlockWindow {
+	window := NewBlockWindow(size)
+	for number := from; number <= to; number++ {
+		window.Add(number, chain[number].Hash())
+	}
+
+	return window
+}
+
+func TestBlockWindowAdd(t *testing.T) {
+	chain := newFakeChain(0, 20, "a")
+	window := windowOf(chain, 0, 20, 8)
+
+	if _, ok := window.Get(12); ok {
+		t.Errorf("Block 12 is out of the window and should be forgotten")
+	}
+
+	for number := uint64(13); number <= 20; number++ {
+		hash, ok := window.Get(number)
+		if false == ok || hash != chain[number].Hash() {
+			t.Errorf("Block %d should be in the window", number)
+		}
+	}
+}
+
+func TestBlockWindowIsReorg(t *testing.T) {
+	chain := newFakeChain(0, 10, "a")
+	window := windowOf(chain, 0, 10, BLOCK_WINDOW_SIZE)
+
+	chain.extend(11, 11, "a")
+	if window.IsReorg(chain.block(11)) {
+		t.Errorf("Block 11 extends the window: not a reorg")
+	}
+
+	if window.IsReorg(newFakeChain(20, 20, "a").block(20)) {
+		t.Errorf("Block 20 has no known parent: not a reorg")
+	}
+
+	fork := newFakeChain(0, 10, "a")
+	fork.extend(9, 11, "b")
+	if false == window.IsReorg(fork.block(11)) {
+		t.Errorf("Block 11 of another branch should be a reorg")
+	}
+
+	if false == window.IsReorg(fork.block(10)) {
+		t.Errorf("Block 10 was already processed: a reorg")
+	}
+
+	if NewBlockWindow(BLOCK_WINDOW_SIZE).IsReorg(fork.block(11)) {
+		t.Errorf("An empty window never detects a reorg")
+	}
+}
+
+func TestBlockWindowTruncate(t *testing.T) {
+	chain := newFakeChain(0, 10, "a")
+	window := windowOf(chain, 0, 10, BLOCK_WINDOW_SIZE)
+
+	window.Truncate(7)
+
+	if _, ok := window.Get(8); ok {
+		t.Errorf("Block 8 should be forgotten")
+	}
+
+	if _, ok := window.Get(7); false == ok {
+		t.Errorf("Block 7 should be kept")
+	}
+
+	if window.IsReorg(chain.block(8)) {
+		t.Errorf("Block 8 extends the truncated window: not a reorg")
+	}
+}
+
+func TestFindCommonAncestor(t *testing.T) {
+	processed := newFakeChain(0, 10, "a")
+	window := windowOf(processed, 0, 10, BLOCK_WINDOW_SIZE)
+
+	tests := []struct {
+		name     string
+		fork     uint64
+		from     uint64
+		expected uint64
+	}{
+		{"last block replaced", 10, 10, 9},
+		{"several blocks replaced", 7, 11, 6},
+		{"walk starts at the window head", 5, 15, 4},
+		{"no block replaced", 11, 10, 10},
+	}
+
+	for _, test := range tests {
+		canonical := newFakeChain(0, 10, "a")
+		canonical.extend(test.fork, 15, "b")
+
+		ancestor, err := window.FindCommonAncestor(context.Background(), canonical, test.from)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if ancestor != test.expected {
+			t.Errorf("%s: common ancestor is %d, expected %d", test.name, ancestor, test.expected)
+		}
+	}
+}
+
+func TestFindCommonAncestorTooDeep(t *testing.T) {
+	processed := newFakeChain(0, 20, "a")
+	window := windowOf(processed, 0, 20, 4)
+
+	canonical := newFakeChain(0, 20, "a")
+	canonical.extend(10, 21, "b")
+
+	_, err := window.FindCommonAncestor(context.Background(), canonical, 20)
+	if false == errors.Is(err, ErrReorgTooDeep) {
+		t.Errorf("A reorg deeper than the window should fail with ErrReorgTooDeep, got %v", err)
+	}
+}
+
+func TestFindCommonAncestorNodeError(t *testing.T) {
+	processed := newFakeChain(0, 10, "a")
+	window := windowOf(processed, 0, 10, BLOCK_WINDOW_SIZE)
+
+	_, err := window.FindCommonAncestor(context.Background(), fakeChain{}, 10)
+	if err == nil || errors.Is(err, ErrReorgTooDeep) {
+		t.Errorf("A header which can't be read should fail with a node error, got %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// RescanStatus is the progress of a rescan of a block range.
+type RescanStatus struct {
+	Running  bool
+	From     uint64
+	To       uint64
+	Address  string
+	Current  uint64
+	Recorded int
+	Error    string
+}
+
+// Rescan processes the blocks from "from" to "to" (included) again, and
+// records the notifications missing for the watched addresses, or only for
+// address if set. Notifications already recorded are left as is, and
+// last_block is not changed.
+func Rescan(config *Config, db Store, client *ethclient.Client, addresses *AddressSet, from, to uint64, address string, progress func(block uint64, recorded int)) (int, error) {
+	recorded := 0
+
+	done := make(chan struct{})
+	defer close(done)
+
+	for fetched := range FetchBlocks(config, client, from, to, done) {
+		if fetched.Err != nil {
+			return recorded, fetched.Err
+		}
+
+		for _, txn := range fetched.Txns {
+			if address != "" && NormalizeAsset(txn.AddressTo) != address && NormalizeAsset(txn.AddressFrom) != address {
+				continue
+			}
+
+			ok, err := ProcessTransaction(config, db, addresses, txn)
+			if err != nil {
+				return recorded, fmt.Errorf("Block %d: %v", fetched.Block.NumberU64(), err)
+			}
+
+			if ok {
+				recorded++
+			}
+		}
+
+		if progress != nil {
+			progress(fetched.Block.NumberU64(), recorded)
+		}
+	}
+
+	// Recorded notifications are considered as just mined: they are
+	// promoted by the Notifier with the next head, the only one updating
+	// confirmations.
+	return recorded, nil
+}
+
+// CheckRescanRange validates a rescan request against the chain head.
+func CheckRescanRange(client *ethclient.Client, addresses *AddressSet, from, to uint64, address string) (string, error) {
+	if from > to {
+		return "", ErrInvalidRequest.Errorf("Invalid range: 'from' (%d) is after 'to' (%d)", from, to)
+	}
+
+	head, err := client.BlockNumber(context.Background())
+	if err != nil {
+		return "", fmt.Errorf("Could not retrieve latest block number: %w", NodeError(err))
+	}
+
+	if to > head {
+		return "", ErrInvalidRequest.Errorf("Invalid range: 'to' (%d) is after the latest block (%d)", to, head)
+	}
+
+	if address == "" {
+		return "", nil
+	}
+
+	if false == IsAddress(address) {
+		return "", ErrInvalidAddress.Errorf("Invalid address %s: Not an hex address", address)
+	}
+
+	if false == addresses.Contains(address) {
+		return "", ErrInvalidRequest.Errorf("Address %s is not watched: Register it first", address)
+	}
+
+	return NormalizeAsset(address), nil
+}
+
+// RescanCommand implements "eth-watcher rescan -from N -to M [-address X]".
+func RescanCommand(config *Config, db Store, pool *NodePool, args []string) error {
+	var from, to uint64
+	var address string
+
+	flags := flag.NewFlagSet("rescan", flag.ContinueOnError)
+	flags.Uint64Var(&from, "from", 0, "First block to scan")
+	flags.Uint64Var(&to, "to", 0, "Last block to scan")
+	flags.StringVar(&address, "address", "", "Only record the notifications of this watched address")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for _, name := range []string{"from", "to"} {
+		if false == set[name] {
+			return fmt.Errorf("Missing -%s: the range to rescan is required", name)
+		}
+	}
+
+	addresses := NewAddressSet()
+	err = addresses.Load(db)
+	if err != nil {
+		return fmt.Errorf("Could not load watched addresses: %v", err)
+	}
+
+	client := pool.Client()
+
+	address, err = CheckRescanRange(client, addresses, from, to, address)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rescanning blocks %d to %d", from, to)
+
+	recorded, err := Rescan(config, db, client, addresses, from, to, address, func(block uint64, recorded int) {
+		if block%1000 == 0 || block == to {
+			log.Printf("Rescan: Done block %d (%d notifications recorded)", block, recorded)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rescan is over: %d notifications recorded.", recorded)
+
+	return nil
+}
+
+// Rescanner runs the rescans requested through the API, one at a time.
+type Rescanner struct {
+	pool   *NodePool
+	mu     sync.Mutex
+	status RescanStatus
+}
+
+func NewRescanner(pool *NodePool) *Rescanner {
+	return &Rescanner{pool: pool}
+}
+
+func (r *Rescanner) Status() RescanStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.status
+}
+
+// Start validates the range and rescans it in the background.
+func (r *Rescanner) Start(config *Config, db Store, addresses *AddressSet, from, to uint64, address string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status.Running {
+		return ErrConflict.Errorf("A rescan of blocks %d to %d is already running", r.status.From, r.status.To)
+	}
+
+	client := r.pool.Client()
+
+	address, err := CheckRescanRange(client, addresses, from, to, address)
+	if err != nil {
+		return err
+	}
+
+	r.status = RescanStatus{Running: true, From: from, To: to, Address: address}
+
+	go func() {
+		recorded, err := Rescan(config, db, client, addresses, from, to, address, func(block uint64, recorded int) {
+			r.mu.Lock()
+			r.status.Current = block
+			r.status.Recorded = recorded
+			r.mu.Unlock()
+		})
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.status.Running = false
+		r.status.Recorded = recorded
+		if err != nil {
+			log.Printf("Rescan of blocks %d to %d failed: %v", from, to, err)
+			r.status.Error = err.Error()
+		} else {
+			log.Printf("Rescan of blocks %d to %d is over: %d notifications recorded", from, to, recorded)
+		}
+	}()
+
+	return nil
+}
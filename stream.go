@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Notifications buffered for a stream client; a client falling further
+	// behind is disconnected, and resumes from its cursor.
+	STREAM_BUFFER_SIZE = 256
+	// Notifications read at once when resuming a stream.
+	STREAM_BATCH_SIZE    = 100
+	STREAM_PING_INTERVAL = 30 * time.Second
+)
+
+// NotificationFilter selects the notifications of a stream. Empty sets match
+// everything; "eth" in Contracts matches Ethereum coin transfers.
+type NotificationFilter struct {
+	Addresses  map[string]bool
+	Contracts  map[string]bool
+	States     map[string]bool
+	Directions map[string]bool
+}
+
+func parseFilterSet(value string) map[string]bool {
+	set := make(map[string]bool)
+
+	for _, item := range strings.Split(value, ",") {
+		item = NormalizeAsset(strings.TrimSpace(item))
+		if item != "" {
+			set[item] = true
+		}
+	}
+
+	return set
+}
+
+// ParseNotificationFilter reads the comma separated 'addresses', 'contracts',
+// 'states' and 'directions' parameters of a stream request.
+func ParseNotificationFilter(values url.Values) (NotificationFilter, error) {
+	filter := NotificationFilter{
+		Addresses:  parseFilterSet(values.Get("addresses")),
+		Contracts:  parseFilterSet(values.Get("contracts")),
+		States:     parseFilterSet(values.Get("states")),
+		Directions: parseFilterSet(values.Get("directions")),
+	}
+
+	for address := range filter.Addresses {
+		if false == IsAddress(address) {
+			return filter, ErrInvalidAddress.Errorf("Invalid 'addresses' field: %s is not an hex address", address)
+		}
+	}
+
+	for contract := range filter.Contracts {
+		if contract != "eth" && false == IsAddress(contract) {
+			return filter, ErrInvalidAddress.Errorf("Invalid 'contracts' field: %s is not an hex address", contract)
+		}
+	}
+
+	for state := range filter.States {
+		if false == IsNotifyState(state) {
+			return filter, ErrInvalidRequest.Errorf("Invalid 'states' field: Unknown state %s", state)
+		}
+	}
+
+	for direction := range filter.Directions {
+		if false == IsDirection(direction) {
+			return filter, ErrInvalidRequest.Errorf("Invalid 'directions' field: Must be in, out or internal")
+		}
+	}
+
+	return filter, nil
+}
+
+func (filter NotificationFilter) Matches(msg NotifyMessage) bool {
+	if len(filter.Addresses) > 0 && false == filter.Addresses[NormalizeAsset(msg.AddressTo)] &&
+		false == filter.Addresses[NormalizeAsset(msg.AddressFrom)] {
+		return false
+	}
+
+	if len(filter.Contracts) > 0 {
+		asset := "eth"
+		if msg.ContractAddress != "" {
+			asset = NormalizeAsset(msg.ContractAddress)
+		}
+
+		if false == filter.Contracts[asset] {
+			return false
+		}
+	}
+
+	if len(filter.States) > 0 && false == filter.States[msg.State] {
+		return false
+	}
+
+	if len(filter.Directions) > 0 && false == filter.Directions[msg.Direction] {
+		return false
+	}
+
+	return true
+}
+
+// Hub broadcasts recorded notifications to the connected stream clients.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[chan NotifyMessage]bool
+}
+
+// Notifications published by this process, for stream clients.
+var hub = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[chan NotifyMessage]bool)}
+}
+
+func (h *Hub) Subscribe() chan NotifyMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan NotifyMessage, STREAM_BUFFER_SIZE)
+	h.subscribers[ch] = true
+
+	return ch
+}
+
+func (h *Hub) Unsubscribe(ch chan NotifyMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subscribers[ch] {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Broadcast never blocks: the channel of a subscriber whose buffer is full
+// is closed.
+func (h *Hub) Broadcast(msg NotifyMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Streamer is the transport of a notification stream.
+type Streamer interface {
+	Send(msg NotifyMessage) error
+	Ping() error
+}
+
+// StreamNotifications sends the notifications matching the filter as they
+// are published, until the context is done or sending fails. If resume is
+// set, notifications recorded after the given id are sent first.
+func StreamNotifications(ctx context.Context, db Store, streamer Streamer, filter NotificationFilter, resume bool, after uint64) error {
+	// Subscribe first, so nothing published while catching up is missed.
+	ch := hub.Subscribe()
+	defer hub.Unsubscribe(ch)
+
+	if resume {
+		for {
+			msgs, err := db.GetNotifications(after, STREAM_BATCH_SIZE, "")
+			if err != nil {
+				return err
+			}
+
+			for _, msg := range msgs {
+				after = msg.ID
+
+				if filter.Matches(msg) {
+					err = streamer.Send(msg)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			if len(msgs) < STREAM_BATCH_SIZE {
+				break
+			}
+		}
+	}
+
+	ticker := time.NewTicker(STREAM_PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case msg, ok := <-ch:
+			if false == ok {
+				return fmt.Errorf("Stream client is too slow")
+			}
+
+			// Already sent while catching up.
+			if resume && msg.ID <= after {
+				continue
+			}
+
+			if filter.Matches(msg) {
+				err := streamer.Send(msg)
+				if err != nil {
+					return err
+				}
+			}
+
+		case <-ticker.C:
+			err := streamer.Ping()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseCursor returns the id to resume a stream after, if any.
+func parseCursor(value string) (bool, uint64, error) {
+	if value == "" {
+		return false, 0, nil
+	}
+
+	after, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return false, 0, ErrInvalidRequest.Errorf("Invalid 'after' field: Not a notification id")
+	}
+
+	return true, after, nil
+}
+
+type websocketStreamer struct {
+	conn *websocket.Conn
+}
+
+func (s websocketStreamer) Send(msg NotifyMessage) error {
+	s.conn.SetWriteDeadline(time.Now().Add(STREAM_PING_INTERVAL))
+	return s.conn.WriteJSON(msg)
+}
+
+func (s websocketStreamer) Ping() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(STREAM_PING_INTERVAL))
+}
+
+var upgrader = websocket.Upgrader{}
+
+// WebsocketNotificationsHandler streams notifications over a WebSocket, as
+// JSON text messages.
+func WebsocketNotificationsHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := ParseNotificationFilter(r.URL.Query())
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+
+		resume, after, err := parseCursor(r.URL.Query().Get("after"))
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebsocketNotificationsHandler: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		// Clients don't send anything but control frames: read them until
+		// the connection is closed.
+		go func() {
+			defer cancel()
+
+			for {
+				_, _, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		err = StreamNotifications(ctx, db, websocketStreamer{conn}, filter, resume, after)
+		if err != nil {
+			log.Printf("WebsocketNotificationsHandler: %v", err)
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()),
+				time.Now().Add(time.Second))
+		}
+	}
+}
+
+type sseStreamer struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (s sseStreamer) Send(msg NotifyMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(s.w, "id: %d\nevent: notification\ndata: %s\n\n", msg.ID, data)
+	if err != nil {
+		return err
+	}
+
+	s.flusher.Flush()
+
+	return nil
+}
+
+func (s sseStreamer) Ping() error {
+	_, err := fmt.Fprint(s.w, ": ping\n\n")
+	if err != nil {
+		return err
+	}
+
+	s.flusher.Flush()
+
+	return nil
+}
+
+// EventsHandler streams notifications as Server-Sent Events. Reconnecting
+// clients resume from their Last-Event-ID header.
+func EventsHandler(config *Config, db Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if false == ok {
+			RespondWithError(w, ErrInternal.Errorf("Streaming is not supported"))
+			return
+		}
+
+		filter, err := ParseNotificationFilter(r.URL.Query())
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+
+		cursor := r.Header.Get("Last-Event-ID")
+		if cursor == "" {
+			cursor = r.URL.Query().Get("after")
+		}
+
+		resume, after, err := parseCursor(cursor)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(200)
+		flusher.Flush()
+
+		err = StreamNotifications(r.Context(), db, sseStreamer{w, flusher}, filter, resume, after)
+		if err != nil {
+			log.Printf("EventsHandler: %v", err)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
@@ -9,6 +11,8 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/gorilla/websocket"
 )
 
@@ -103,13 +107,15 @@ func SendMessage(c *websocket.Conn, messageId int, subscription string) (string,
 	return resp.Result, err
 }
 
-func ConnectWS(config *Config, ch chan<- ObjMessage) error {
+// ConnectWS subscribes to the new heads and pending transactions of a node,
+// until the connection fails or changed is closed.
+func ConnectWS(config *Config, node *Node, changed <-chan struct{}, ch chan<- ObjMessage) error {
 	var MessageId int
 	MessageId = 1
 
-	log.Printf("Connecting to Ethereum Websocket")
+	log.Printf("Connecting to Ethereum Websocket of node '%s'", node.Name)
 
-	u := url.URL{Scheme: "ws", Host: config.WebsocketURL, Path: "/"}
+	u := url.URL{Scheme: "ws", Host: node.WebsocketURL, Path: "/"}
 
 	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
@@ -117,6 +123,18 @@ func ConnectWS(config *Config, ch chan<- ObjMessage) error {
 	}
 	defer c.Close()
 
+	done := make(chan struct{})
+	defer close(done)
+
+	// Failover: closing the connection ends the read loop.
+	go func() {
+		select {
+		case <-changed:
+			c.Close()
+		case <-done:
+		}
+	}()
+
 	subHashHeads, err := SendMessage(c, MessageId, "newHeads")
 	if err != nil {
 		return fmt.Errorf("SendMessage: newHeads: %v", err)
@@ -167,119 +185,415 @@ func ConnectWS(config *Config, ch chan<- ObjMessage) error {
 	}
 }
 
-func Listener(config *Config, ch <-chan ObjMessage, notifyChannel chan<- NotifyMessage, last_id uint64) {
-	client, err := ConnectRPC(config)
-	if err != nil {
-		panic(err)
+// EmitBlock sends the notifications of a block, then the admin message
+// recording it as processed.
+func EmitBlock(window *BlockWindow, block *types.Block, txns []NotifyMessage, notifyChannel chan<- NotifyMessage) {
+	for _, txn := range txns {
+		notifyChannel <- txn
+	}
+
+	notifyChannel <- NotifyMessage{
+		MessageType: NOTIFY_TYPE_ADMIN,
+		Amount:      block.Number(),
+		BlockHash:   block.Hash().Hex()[2:],
+	}
+
+	window.Add(block.NumberU64(), block.Hash())
+}
+
+// ProcessBlock emits a block which extends the chain processed so far. A
+// block which does not is handled as a reorg first, and a block already
+// processed is skipped. On error, nothing is emitted past the head of the
+// window: the blocks left are to be processed again.
+func ProcessBlock(config *Config, client *ethclient.Client, window *BlockWindow, block *types.Block, txns []NotifyMessage, notifyChannel chan<- NotifyMessage) error {
+	if hash, ok := window.Get(block.NumberU64()); ok && hash == block.Hash() {
+		return nil
+	}
+
+	if window.IsReorg(block) {
+		err := HandleReorg(config, client, window, block, notifyChannel)
+		if errors.Is(err, ErrReorgTooDeep) {
+			// None of the blocks processed is left to compare with: the
+			// notifications of the replaced ones can't be reverted.
+			log.Println("Listener:", err)
+			window.Reset()
+		} else if err != nil {
+			return err
+		}
 	}
-	defer client.Close()
+
+	EmitBlock(window, block, txns, notifyChannel)
+
+	return nil
+}
+
+func Listener(config *Config, pool *NodePool, ch <-chan ObjMessage, notifyChannel chan<- NotifyMessage, last_id uint64, window *BlockWindow) {
+	// Pending transactions are looked up concurrently; when the workers
+	// can't keep up, lookups are dropped: mined transactions are still
+	// found in their block.
+	hashes := TransactionWorkers(config, pool, notifyChannel)
+	dropped := 0
 
 	for message := range ch {
 		switch message.Type {
 		case TYPE_BLOCK_HASH:
-			// Recovery: We get a recent block, but the last we parsed is more older that current - 1
-			if last_id != 0 {
-				last := new(big.Int)
-				last.SetUint64(last_id + 1)
-
-				for 0 != last.Cmp(message.Number) {
-					log.Printf("Recovery: Doing block %s", last.Text(10))
-					_, txns, err := ReadBlock(client, "", last)
-					if err != nil {
-						log.Println("Listener:", err)
-						continue
-					}
+			if dropped > 0 {
+				log.Printf("Listener: Dropped %d pending transaction lookups: Increase tx_workers", dropped)
+				dropped = 0
+			}
 
-					for _, txn := range txns {
-						notifyChannel <- txn
-					}
+			client := pool.Client()
+
+			// Recovery: We get a recent block, but the last we parsed is more older that current - 1.
+			// Heads may be skipped after a restart, a reconnection, or between two polls.
+			if last_id != 0 && message.Number.Uint64() > last_id+1 {
+				log.Printf("Recovery: Doing blocks %d to %d", last_id+1, message.Number.Uint64()-1)
 
-					notifyChannel <- NotifyMessage{
-						MessageType: NOTIFY_TYPE_ADMIN,
-						Amount:      last,
+				var err error
+				done := make(chan struct{})
+
+				for fetched := range FetchBlocks(config, client, last_id+1, message.Number.Uint64()-1, done) {
+					err = fetched.Err
+					if err == nil {
+						err = ProcessBlock(config, client, window, fetched.Block, fetched.Txns, notifyChannel)
+					}
+					if err != nil {
+						break
 					}
 
-					last.SetUint64(last.Uint64() + 1)
+					log.Printf("Recovery: Done block %d", fetched.Block.NumberU64())
+					last_id = fetched.Block.NumberU64()
 				}
 
-				// We set last_id a 0. We don't want this process to restart.
-				log.Printf("Recovery is over: Done up to block %s", last.Text(10))
+				close(done)
 
-				last_id = 0
+				// The blocks left are recovered with the next head.
+				if err != nil {
+					pool.Report(client, err)
+					last_id = resumeFrom(window, last_id)
+					log.Printf("Recovery: %v: Done up to block %d", err, last_id)
+					continue
+				}
+
+				log.Printf("Recovery is over: Done up to block %d", last_id)
 			}
 
 			// Retrieve the block, and check all transactions
-			last, txns, err := ReadBlock(client, message.Hash, nil)
+			ctx, cancel := context.WithTimeout(context.Background(), config.RPCTimeout)
+			block, txns, err := ReadBlock(ctx, client, message.Hash, nil)
+			cancel()
+			pool.Report(client, err)
 			if err != nil {
 				log.Println("Listener:", err)
 				continue
 			}
 
-			for _, txn := range txns {
-				notifyChannel <- txn
+			err = ProcessBlock(config, client, window, block, txns, notifyChannel)
+			if err != nil {
+				// The canonical blocks left are recovered with the next
+				// head.
+				pool.Report(client, err)
+				last_id = resumeFrom(window, last_id)
+				log.Printf("Listener: %v: Done up to block %d", err, last_id)
+				continue
 			}
 
-			notifyChannel <- NotifyMessage{
-				MessageType: NOTIFY_TYPE_ADMIN,
-				Amount:      last,
-			}
+			last_id = block.NumberU64()
 
 		case TYPE_TXN_HASH:
-			txn, err := ReadTransaction(client, message.Hash)
-			if err != nil {
-				log.Println("Listener:", err)
-				continue
+			select {
+			case hashes <- message.Hash:
+			default:
+				dropped++
+			}
+		}
+	}
+}
+
+// resumeFrom returns the last block processed once a reorg was handled, the
+// head of the window, which a failure may leave below last_id.
+func resumeFrom(window *BlockWindow, last_id uint64) uint64 {
+	if window.IsEmpty() {
+		return last_id
+	}
+
+	return window.head
+}
+
+// HandleReorg finds the common ancestor between the chain we processed and
+// the branch of the given block, reverts everything above it and re-scans
+// the canonical blocks up to (but not including) the given one. When one of
+// them can't be read, or does not extend the blocks re-scanned before it
+// (the chain changed again), the window ends at the last one re-scanned and
+// an error is returned. ErrReorgTooDeep is returned when there is no common
+// ancestor in the window.
+func HandleReorg(config *Config, client *ethclient.Client, window *BlockWindow, block *types.Block, notifyChannel chan<- NotifyMessage) error {
+	if block.NumberU64() == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.RPCTimeout)
+	ancestor, err := window.FindCommonAncestor(ctx, client, block.NumberU64()-1)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reorg: Block %d (%s) does not extend our chain; common ancestor is block %d",
+		block.NumberU64(), block.Hash().Hex(), ancestor)
+
+	notifyChannel <- NotifyMessage{
+		MessageType: NOTIFY_TYPE_REORG,
+		BlockNumber: ancestor,
+	}
+
+	window.Truncate(ancestor)
+
+	if ancestor+1 < block.NumberU64() {
+		done := make(chan struct{})
+		defer close(done)
+
+		for fetched := range FetchBlocks(config, client, ancestor+1, block.NumberU64()-1, done) {
+			if fetched.Err != nil {
+				return fmt.Errorf("Reorg: %w", fetched.Err)
+			}
+
+			if window.IsReorg(fetched.Block) {
+				return fmt.Errorf("Reorg: Block %d does not extend the blocks re-scanned: The chain changed again", fetched.Block.NumberU64())
 			}
 
-			notifyChannel <- txn
+			log.Printf("Reorg: Re-scanned block %d", fetched.Block.NumberU64())
+			EmitBlock(window, fetched.Block, fetched.Txns, notifyChannel)
 		}
 	}
+
+	if window.IsReorg(block) {
+		return fmt.Errorf("Reorg: Block %d does not extend the blocks re-scanned: The chain changed again", block.NumberU64())
+	}
+
+	return nil
+}
+
+// PublishNotification records a notification, queued for the matching
+// webhooks, then broadcasts it to stream clients. It returns whether it was
+// recorded: a transfer already recorded is not published again.
+func PublishNotification(db Store, message NotifyMessage) (bool, error) {
+	id, err := db.InsertNotification(message)
+	if err != nil || id == 0 {
+		return false, err
+	}
+
+	message.ID = id
+
+	hub.Broadcast(message)
+
+	return true, nil
+}
+
+// PromoteNotifications updates the confirmations of the mined notifications
+// against the given head, and broadcasts the ones which changed state.
+func PromoteNotifications(db Store, head uint64) error {
+	promoted, err := db.UpdateConfirmations(head)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range promoted {
+		hub.Broadcast(message)
+	}
+
+	return nil
+}
+
+// ProcessTransaction records the notification of a transaction involving a
+// watched address, unless it was already recorded. It returns whether it was
+// recorded.
+func ProcessTransaction(config *Config, db Store, addresses *AddressSet, message NotifyMessage) (bool, error) {
+	if message.Status == TX_STATUS_FAILED && config.SuppressFailedTransactions {
+		// Not reported: nor is it pending any longer.
+		return false, db.DeletePendingNotifications(message.TxHash)
+	}
+
+	toKnown := addresses.Contains(message.AddressTo)
+	fromKnown := addresses.Contains(message.AddressFrom)
+
+	if false == toKnown && false == fromKnown {
+		return false, nil
+	}
+
+	message.Direction = GetDirection(fromKnown, toKnown)
+
+	message.RequiredConfirmations = config.GetRequiredConfirmations(message.ContractAddress)
+	if message.State == NOTIFY_STATE_MINED {
+		message.State = ConfirmationState(message.Confirmations, message.RequiredConfirmations)
+	}
+
+	// Blocks may be processed again, after a restart or by a rescan: the
+	// notifications already recorded are skipped.
+	return PublishNotification(db, message)
 }
 
-func Notifier(config *Config, db *DB, ch <-chan NotifyMessage) {
+// Delays between attempts to record the notification of a block.
+const (
+	NOTIFY_RETRY_DELAY     = time.Second
+	NOTIFY_RETRY_MAX_DELAY = time.Minute
+)
+
+// IsTransientError tells whether an error recording a notification may go
+// away by itself: a database or node connection issue.
+func IsTransientError(db Store, err error) bool {
+	return errors.Is(err, ErrNodeUnavailable) || errors.Is(err, ErrNodeTimeout) || db.Transient(err)
+}
+
+// Notifier records the notifications of the processed blocks, in order. A
+// notification of a block which can't be recorded because of a transient
+// error (database unavailable...) is retried until it is, so last_block is
+// only recorded once every notification before it was. Other errors are
+// logged and the notification skipped.
+func Notifier(config *Config, db Store, addresses *AddressSet, ch <-chan NotifyMessage, heads chan<- uint64) {
 	for message := range ch {
 		if message.MessageType == NOTIFY_TYPE_NONE {
 			continue
 		}
 
 		if message.MessageType == NOTIFY_TYPE_ADMIN {
-			db.SetSetting("last_block", message.Amount.Text(10))
+			err := db.SetLastBlock(message.Amount.Uint64(), message.BlockHash, BLOCK_WINDOW_SIZE)
+			if err != nil {
+				log.Println("Notifier: Could not record last block:", err)
+			}
+
+			err = PromoteNotifications(db, message.Amount.Uint64())
+			if err != nil {
+				log.Println(err)
+			}
+
+			// The tracker only cares about the latest head: never block on it.
+			select {
+			case heads <- message.Amount.Uint64():
+			default:
+			}
 			continue
 		}
 
-		isKnown, err := db.IsAddressKnown(message.AddressTo)
-		if err != nil {
+		delay := NOTIFY_RETRY_DELAY
+
+		for {
+			var err error
+
+			if message.MessageType == NOTIFY_TYPE_REORG {
+				err = RevertNotifications(db, message.BlockNumber)
+			} else {
+				_, err = ProcessTransaction(config, db, addresses, message)
+			}
+
+			if err == nil {
+				break
+			}
+
 			log.Println(err)
-			continue
-		}
 
-		if false == isKnown {
-			continue
+			// A pending transaction is seen again once mined, and an error
+			// which is not transient (a value refused by the database...)
+			// would block every notification after this one.
+			if message.IsPending {
+				break
+			}
+
+			if false == IsTransientError(db, err) {
+				log.Printf("Notifier: Skipped notification of tx %s in block %d", message.TxHash, message.BlockNumber)
+				break
+			}
+
+			log.Printf("Notifier: Retrying in %v", delay)
+			time.Sleep(delay)
+
+			delay *= 2
+			if delay > NOTIFY_RETRY_MAX_DELAY {
+				delay = NOTIFY_RETRY_MAX_DELAY
+			}
 		}
+	}
+}
 
-		err = db.InsertNotification(
-			message.AddressFrom,
-			message.AddressTo,
-			message.ContractAddress,
-			message.Amount.Text(10),
-			message.IsPending,
-			message.TxHash,
-		)
+// RevertNotifications marks notifications mined above the given block as
+// orphaned, and records a reverted notification for each of them.
+func RevertNotifications(db Store, ancestor uint64) error {
+	orphaned, err := db.OrphanNotifications(ancestor)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range orphaned {
+		log.Printf("Reorg: Reverting notification for tx %s (block %d)", message.TxHash, message.BlockNumber)
+
+		message.State = NOTIFY_STATE_REVERTED
+		message.Confirmations = 0
+
+		_, err = PublishNotification(db, message)
 		if err != nil {
-			log.Println(err)
-			continue
+			return err
 		}
 	}
+
+	return nil
 }
 
-func Subscriber(config *Config, notifyChannel chan<- NotifyMessage, last_id uint64) {
+// Delay before connecting to the WebSocket again, once polling took over
+// after repeated failures.
+const WEBSOCKET_RETRY_INTERVAL = 5 * time.Minute
+
+// Subscriber feeds Listener with new heads and pending transactions of the
+// node in use, from its WebSocket subscriptions or, without WebSocket, by
+// polling its RPC API. It reconnects to another node on failover.
+func Subscriber(config *Config, pool *NodePool, notifyChannel chan<- NotifyMessage, last_id uint64, window *BlockWindow) {
 	ch := make(chan ObjMessage, 1024)
 
-	go Listener(config, ch, notifyChannel, last_id)
+	go Listener(config, pool, ch, notifyChannel, last_id, window)
+
+	var current *Node
+	failures := 0
 
 	for {
+		node, changed := pool.Active()
+		if node != current {
+			current = node
+			failures = 0
+		}
+
+		if node.WebsocketURL == "" || failures >= config.WebsocketMaxFailures {
+			var ctx context.Context
+			var cancel context.CancelFunc
+
+			if node.WebsocketURL == "" {
+				ctx, cancel = context.WithCancel(context.Background())
+			} else {
+				log.Printf("Subscriber: Websocket failed %d times in a row: Polling RPC API for %v", failures, WEBSOCKET_RETRY_INTERVAL)
+				ctx, cancel = context.WithTimeout(context.Background(), WEBSOCKET_RETRY_INTERVAL)
+			}
+
+			// Failover: polling stops once another node is selected.
+			go func() {
+				select {
+				case <-changed:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+
+			err := PollRPC(ctx, config, node, ch)
+			cancel()
+
+			if err != nil {
+				log.Println(err)
+				time.Sleep(time.Second * 5)
+			}
+
+			failures = 0
+			continue
+		}
+
 		ts_startup := time.Now()
-		err := ConnectWS(config, ch)
+		err := ConnectWS(config, node, changed, ch)
 		if err != nil {
 			log.Println(err)
 		}
@@ -287,8 +601,12 @@ func Subscriber(config *Config, notifyChannel chan<- NotifyMessage, last_id uint
 		elapsed := time.Now().Sub(ts_startup)
 
 		if elapsed < time.Second*5 {
+			failures++
+
 			// Wait a few seconds before retrying
 			time.Sleep(time.Second * 5)
+		} else {
+			failures = 0
 		}
 	}
 }
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// Status of outgoing transactions.
+const (
+	TX_PENDING   = "pending"
+	TX_MINED     = "mined"
+	TX_CONFIRMED = "confirmed"
+	TX_FAILED    = "failed"
+	TX_DROPPED   = "dropped"
+	TX_REPLACED  = "replaced"
+)
+
+// Gas limit of the 0 ETH self transfer cancelling a transaction.
+const CANCEL_GAS_LIMIT = 21000
+
+// Heads in a row a transaction must be found gone at before it is dropped:
+// a node behind a load balancer may not know it yet, or no longer.
+const TX_DROPPED_AFTER_MISSES = 3
+
+// OutgoingTransaction is a transaction sent by eth-watcher, tracked until it
+// is confirmed, failed, dropped or replaced.
+type OutgoingTransaction struct {
+	TxHash               string
+	AddressFrom          string
+	AddressTo            string
+	ContractAddress      string
+	Amount               *big.Int
+	Nonce                uint64
+	GasLimit             uint64
+	GasPrice             *big.Int
+	MaxFeePerGas         *big.Int
+	MaxPriorityFeePerGas *big.Int
+	RawTx                string
+	Status               string
+	BlockNumber          uint64
+	BlockHash            string
+	Confirmations        uint64
+	GasUsed              uint64
+	EffectiveGasPrice    *big.Int
+	// Hashes of the transaction this one replaces with the same nonce, and
+	// of the one replacing it; Replacements counts the replaced ancestors.
+	Replaces     string
+	ReplacedBy   string
+	Replacements int
+	// First head at which the tracker saw the transaction pending.
+	BroadcastBlock uint64
+}
+
+func NormalizeTxHash(hash string) string {
+	return strings.TrimPrefix(strings.ToLower(hash), "0x")
+}
+
+// NewOutgoingTransaction describes a signed transaction sending amount of
+// the given contract's token (ETH if empty) to recipient.
+func NewOutgoingTransaction(tx *types.Transaction, recipient, contractAddress string, amount *big.Int) (OutgoingTransaction, error) {
+	from, err := GetTransactionFrom(tx)
+	if err != nil {
+		return OutgoingTransaction{}, err
+	}
+
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return OutgoingTransaction{}, err
+	}
+
+	outgoing := OutgoingTransaction{
+		TxHash:          NormalizeTxHash(tx.Hash().Hex()),
+		AddressFrom:     strings.ToLower(from.Hex()[2:]),
+		AddressTo:       NormalizeAsset(recipient),
+		ContractAddress: NormalizeAsset(contractAddress),
+		Amount:          amount,
+		Nonce:           tx.Nonce(),
+		GasLimit:        tx.Gas(),
+		RawTx:           hex.EncodeToString(raw),
+		Status:          TX_PENDING,
+	}
+
+	if tx.Type() == types.DynamicFeeTxType {
+		outgoing.MaxFeePerGas = tx.GasFeeCap()
+		outgoing.MaxPriorityFeePerGas = tx.GasTipCap()
+	} else {
+		outgoing.GasPrice = tx.GasPrice()
+	}
+
+	return outgoing, nil
+}
+
+// ToNotification returns the notification emitted when the transaction
+// changes status.
+func (tx OutgoingTransaction) ToNotification(config *Config) NotifyMessage {
+	status := ""
+	switch tx.Status {
+	case TX_MINED, TX_CONFIRMED:
+		status = TX_STATUS_SUCCESS
+	case TX_FAILED:
+		status = TX_STATUS_FAILED
+	}
+
+	direction := DIRECTION_OUT
+	if tx.AddressTo == tx.AddressFrom {
+		direction = DIRECTION_INTERNAL
+	}
+
+	return NotifyMessage{
+		MessageType:           NOTIFY_TYPE_OUTGOING,
+		Direction:             direction,
+		AddressFrom:           tx.AddressFrom,
+		AddressTo:             tx.AddressTo,
+		Amount:                tx.Amount,
+		ContractAddress:       tx.ContractAddress,
+		IsPending:             tx.Status == TX_PENDING,
+		TxHash:                tx.TxHash,
+		LogIndex:              -1,
+		BlockNumber:           tx.BlockNumber,
+		BlockHash:             tx.BlockHash,
+		Confirmations:         tx.Confirmations,
+		RequiredConfirmations: config.GetRequiredConfirmations(tx.ContractAddress),
+		State:                 tx.Status,
+		Status:                status,
+		GasUsed:               tx.GasUsed,
+		EffectiveGasPrice:     tx.EffectiveGasPrice,
+	}
+}
+
+// RecordTransaction persists a transaction just broadcast, so it is tracked.
+func RecordTransaction(config *Config, db Store, tx *types.Transaction, recipient, contractAddress string, amount *big.Int) {
+	outgoing, err := NewOutgoingTransaction(tx, recipient, contractAddress, amount)
+	if err != nil {
+		log.Printf("RecordTransaction(%s): %v", tx.Hash().Hex(), err)
+		return
+	}
+
+	err = db.InsertTransaction(outgoing)
+	if err != nil {
+		log.Printf("RecordTransaction(%s): %v", tx.Hash().Hex(), err)
+		return
+	}
+
+	_, err = PublishNotification(db, outgoing.ToNotification(config))
+	if err != nil {
+		log.Printf("RecordTransaction(%s): %v", tx.Hash().Hex(), err)
+	}
+}
+
+// transactionGone tells whether a transaction without receipt left the
+// node: its nonce was consumed by another transaction, or the node forgot
+// it. A replaced transaction leaves the pool at once, but may still be
+// mined instead of its replacement until its nonce is consumed.
+func transactionGone(ctx context.Context, client *ethclient.Client, tx OutgoingTransaction) (bool, error) {
+	nonce, err := client.NonceAt(ctx, common.HexToAddress(tx.AddressFrom), nil)
+	if err != nil {
+		return false, NodeError(err)
+	}
+
+	if nonce > tx.Nonce {
+		return true, nil
+	}
+
+	_, _, err = client.TransactionByHash(ctx, common.HexToHash(tx.TxHash))
+	if err == ethereum.NotFound {
+		return tx.ReplacedBy == "", nil
+	}
+
+	return false, NodeError(err)
+}
+
+// TrackTransaction returns the transaction updated against the chain at the
+// given head. misses counts, by hash, the heads in a row transactions were
+// found gone at.
+func TrackTransaction(ctx context.Context, config *Config, client *ethclient.Client, tx OutgoingTransaction, head uint64, misses map[string]int) (OutgoingTransaction, error) {
+	hash := common.HexToHash(tx.TxHash)
+
+	receipt, err := client.TransactionReceipt(ctx, hash)
+	if err == ethereum.NotFound {
+		gone, err := transactionGone(ctx, client, tx)
+		if err != nil {
+			return tx, err
+		}
+
+		if gone {
+			// It may have been mined since its receipt was looked up.
+			receipt, err = client.TransactionReceipt(ctx, hash)
+			if err != nil && err != ethereum.NotFound {
+				return tx, NodeError(err)
+			}
+		}
+
+		if receipt == nil {
+			tx.BlockNumber = 0
+			tx.BlockHash = ""
+			tx.Confirmations = 0
+			tx.GasUsed = 0
+			tx.EffectiveGasPrice = nil
+			tx.Status = TX_PENDING
+
+			if false == gone {
+				delete(misses, tx.TxHash)
+				return tx, nil
+			}
+
+			misses[tx.TxHash]++
+			if misses[tx.TxHash] < TX_DROPPED_AFTER_MISSES {
+				return tx, nil
+			}
+
+			delete(misses, tx.TxHash)
+
+			tx.Status = TX_DROPPED
+			if tx.ReplacedBy != "" {
+				tx.Status = TX_REPLACED
+			}
+
+			return tx, nil
+		}
+	} else if err != nil {
+		return tx, NodeError(err)
+	}
+
+	delete(misses, tx.TxHash)
+
+	tx.BlockNumber = receipt.BlockNumber.Uint64()
+	tx.BlockHash = NormalizeTxHash(receipt.BlockHash.Hex())
+	tx.GasUsed = receipt.GasUsed
+	tx.EffectiveGasPrice = receipt.EffectiveGasPrice
+
+	tx.Confirmations = 0
+	if head >= tx.BlockNumber {
+		tx.Confirmations = head - tx.BlockNumber + 1
+	}
+
+	switch {
+	case receipt.Status == types.ReceiptStatusFailed:
+		tx.Status = TX_FAILED
+	case tx.Confirmations >= config.GetRequiredConfirmations(tx.ContractAddress):
+		tx.Status = TX_CONFIRMED
+	default:
+		tx.Status = TX_MINED
+	}
+
+	return tx, nil
+}
+
+// ReplaceTransaction re-signs the nonce of a pending transaction with
+// higher fees: the same transfer to speed it up, or a 0 ETH transfer to its
+// sender to cancel it. The replacement is broadcast and recorded.
+func ReplaceTransaction(ctx context.Context, config *Config, db Store, client *ethclient.Client, old OutgoingTransaction, private string, opts TxOptions, cancel bool) (*types.Transaction, error) {
+	if old.Status != TX_PENDING {
+		return nil, ErrConflict.Errorf("Transaction %s is %s: Only pending transactions can be replaced", old.TxHash, old.Status)
+	}
+
+	if old.ReplacedBy != "" {
+		return nil, ErrConflict.Errorf("Transaction %s was already replaced by %s", old.TxHash, old.ReplacedBy)
+	}
+
+	raw, err := hex.DecodeString(old.RawTx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode raw transaction: %v", err)
+	}
+
+	previous := new(types.Transaction)
+	err = previous.UnmarshalBinary(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode raw transaction: %v", err)
+	}
+
+	key, err := crypto.HexToECDSA(private)
+	if err != nil {
+		return nil, err
+	}
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	if strings.ToLower(from.Hex()[2:]) != old.AddressFrom {
+		return nil, ErrInvalidRequest.Errorf("Private key doesn't match the sender of transaction %s", old.TxHash)
+	}
+
+	chainID, err := GetChainID(ctx, config, client)
+	if err != nil {
+		return nil, err
+	}
+
+	fees, err := ReplacementFees(ctx, client, previous, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	to := *previous.To()
+	value := previous.Value()
+	data := previous.Data()
+	gasLimit := previous.Gas()
+	recipient, contractAddress, amount := old.AddressTo, old.ContractAddress, old.Amount
+
+	if cancel {
+		to = from
+		value = big.NewInt(0)
+		data = nil
+		gasLimit = CANCEL_GAS_LIMIT
+		recipient, contractAddress, amount = old.AddressFrom, "", big.NewInt(0)
+	}
+
+	if opts.GasLimit != 0 {
+		gasLimit = opts.GasLimit
+	}
+
+	tx := NewTransaction(chainID, previous.Nonce(), to, value, gasLimit, fees, data)
+
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(chainID), key)
+	if err != nil {
+		return nil, fmt.Errorf("Signature creation error: %v", err)
+	}
+
+	err = BroadcastTransaction(config, client, signedTx)
+	if err != nil {
+		return nil, fmt.Errorf("Send tx error: %w", NodeError(err))
+	}
+
+	replacement, err := NewOutgoingTransaction(signedTx, recipient, contractAddress, amount)
+	if err != nil {
+		log.Printf("ReplaceTransaction(%s): %v", old.TxHash, err)
+		return signedTx, nil
+	}
+
+	replacement.Replaces = old.TxHash
+	replacement.Replacements = old.Replacements + 1
+
+	err = db.InsertTransaction(replacement)
+	if err != nil {
+		log.Printf("ReplaceTransaction(%s): %v", old.TxHash, err)
+		return signedTx, nil
+	}
+
+	old.ReplacedBy = replacement.TxHash
+
+	err = db.UpdateTransaction(old)
+	if err != nil {
+		log.Printf("ReplaceTransaction(%s): %v", old.TxHash, err)
+	}
+
+	_, err = PublishNotification(db, replacement.ToNotification(config))
+	if err != nil {
+		log.Printf("ReplaceTransaction(%s): %v", old.TxHash, err)
+	}
+
+	return signedTx, nil
+}
+
+// AutoSpeedUp replaces a transaction still pending after the configured
+// number of blocks, signing with its sender's stored key.
+func AutoSpeedUp(config *Config, db Store, client *ethclient.Client, tx OutgoingTransaction, head uint64) {
+	if config.AutoSpeedUpBlocks == 0 || tx.Status != TX_PENDING || tx.ReplacedBy != "" {
+		return
+	}
+
+	if tx.BroadcastBlock == 0 || head < tx.BroadcastBlock+config.AutoSpeedUpBlocks || tx.Replacements >= config.MaxReplacements {
+		return
+	}
+
+	private, err := db.GetKey(tx.AddressFrom)
+	if err != nil || private == "" {
+		log.Printf("AutoSpeedUp(%s): No stored private key for %s", tx.TxHash, tx.AddressFrom)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.RPCTimeout)
+	defer cancel()
+
+	replacement, err := ReplaceTransaction(ctx, config, db, client, tx, private, TxOptions{}, false)
+	if err != nil {
+		log.Printf("AutoSpeedUp(%s): %v", tx.TxHash, err)
+		return
+	}
+
+	log.Printf("AutoSpeedUp: Transaction %s replaced by %s", tx.TxHash, replacement.Hash().Hex())
+}
+
+// Tracker follows outgoing transactions as new heads are processed, and
+// emits a notification each time one changes status. The nonce of a dropped
+// transaction is released, so the next send from its address fills the gap.
+func Tracker(config *Config, db Store, pool *NodePool, nonces *NonceManager, heads <-chan uint64) {
+	misses := make(map[string]int)
+
+	for head := range heads {
+		client := pool.Client()
+
+		txs, err := db.GetTrackedTransactions()
+		if err != nil {
+			log.Println("Tracker:", err)
+			continue
+		}
+
+		for _, tx := range txs {
+			ctx, cancel := context.WithTimeout(context.Background(), config.RPCTimeout)
+			updated, err := TrackTransaction(ctx, config, client, tx, head, misses)
+			cancel()
+			pool.Report(client, err)
+			if err != nil {
+				log.Printf("Tracker(%s): %v", tx.TxHash, err)
+				continue
+			}
+
+			if updated.Status == TX_PENDING && updated.BroadcastBlock == 0 {
+				updated.BroadcastBlock = head
+			}
+
+			err = UpdateTrackedTransaction(config, db, tx, updated)
+			if err != nil {
+				log.Printf("Tracker(%s): %v", tx.TxHash, err)
+				continue
+			}
+
+			if updated.Status == TX_DROPPED {
+				nonces.Release(common.HexToAddress(updated.AddressFrom), updated.Nonce)
+			}
+
+			AutoSpeedUp(config, db, client, updated, head)
+		}
+	}
+}
+
+// UpdateTrackedTransaction saves a tracked transaction if it changed, and
+// emits a notification if its status or block did.
+func UpdateTrackedTransaction(config *Config, db Store, tx, updated OutgoingTransaction) error {
+	if updated.Status == tx.Status && updated.Confirmations == tx.Confirmations &&
+		updated.BlockHash == tx.BlockHash && updated.BroadcastBlock == tx.BroadcastBlock {
+		return nil
+	}
+
+	err := db.UpdateTransaction(updated)
+	if err != nil {
+		return err
+	}
+
+	if updated.Status == tx.Status && updated.BlockHash == tx.BlockHash {
+		return nil
+	}
+
+	log.Printf("Tracker: Transaction %s is now %s", tx.TxHash, updated.Status)
+
+	_, err = PublishNotification(db, updated.ToNotification(config))
+
+	return err
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status of webhook deliveries.
+const (
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_DEAD      = "dead"
+)
+
+const (
+	WEBHOOK_SIGNATURE_HEADER = "X-Eth-Watcher-Signature"
+	WEBHOOK_TIMESTAMP_HEADER = "X-Eth-Watcher-Timestamp"
+	WEBHOOK_DELIVERY_HEADER  = "X-Eth-Watcher-Delivery"
+
+	// Delay between two scans of the delivery queue, deliveries read per
+	// webhook and scan, and webhooks delivered to at once.
+	WEBHOOK_POLL_INTERVAL = time.Second
+	WEBHOOK_BATCH_SIZE    = 100
+	WEBHOOK_CONCURRENCY   = 10
+)
+
+// Webhook is an endpoint notifications are POSTed to: all of them, or only
+// the ones from or to Address.
+type Webhook struct {
+	ID      string
+	URL     string
+	Address string
+	Secret  string
+}
+
+// WebhookDelivery is a notification queued for a webhook, retried until it
+// is delivered or gives up as dead.
+type WebhookDelivery struct {
+	ID            uint64
+	WebhookID     string
+	Payload       string
+	Status        string
+	Attempts      int
+	NextAttemptAt int64
+	LastError     string
+}
+
+func IsDeliveryStatus(status string) bool {
+	return status == DELIVERY_PENDING || status == DELIVERY_DELIVERED || status == DELIVERY_DEAD
+}
+
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+
+	_, err := io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// NewWebhook validates a webhook registration. A secret is generated if none
+// is given.
+func NewWebhook(rawURL, address, secret string) (Webhook, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return Webhook{}, ErrInvalidRequest.Errorf("Invalid 'url' field: Not an http(s) URL")
+	}
+
+	if address != "" && false == IsAddress(address) {
+		return Webhook{}, ErrInvalidAddress.Errorf("Invalid 'address' field: Not an hex address")
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	if secret == "" {
+		secret, err = randomHex(32)
+		if err != nil {
+			return Webhook{}, err
+		}
+	}
+
+	return Webhook{
+		ID:      id,
+		URL:     rawURL,
+		Address: NormalizeAsset(address),
+		Secret:  secret,
+	}, nil
+}
+
+func (hook Webhook) Matches(msg NotifyMessage) bool {
+	if hook.Address == "" {
+		return true
+	}
+
+	return hook.Address == NormalizeAsset(msg.AddressTo) || hook.Address == NormalizeAsset(msg.AddressFrom)
+}
+
+// NewWebhookDeliveries returns the deliveries of a recorded notification to
+// the matching webhooks.
+func NewWebhookDeliveries(hooks []Webhook, msg NotifyMessage) ([]WebhookDelivery, error) {
+	deliveries := make([]WebhookDelivery, 0)
+
+	var payload []byte
+	var err error
+
+	for _, hook := range hooks {
+		if false == hook.Matches(msg) {
+			continue
+		}
+
+		if payload == nil {
+			payload, err = json.Marshal(msg)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		deliveries = append(deliveries, WebhookDelivery{
+			WebhookID:     hook.ID,
+			Payload:       string(payload),
+			Status:        DELIVERY_PENDING,
+			NextAttemptAt: time.Now().Unix(),
+		})
+	}
+
+	return deliveries, nil
+}
+
+// SignWebhookPayload returns the signature header of a delivery: the
+// HMAC-SHA256 of "<timestamp>.<payload>" keyed with the webhook secret.
+func SignWebhookPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeliverWebhook POSTs a delivery; any status but 2xx is a failure.
+func DeliverWebhook(client *http.Client, hook Webhook, delivery WebhookDelivery) error {
+	payload := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest("POST", hook.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, strconv.FormatUint(delivery.ID, 10))
+	req.Header.Set(WEBHOOK_TIMESTAMP_HEADER, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, SignWebhookPayload(hook.Secret, timestamp, payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected response status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// WebhookRetryDelay returns the delay before retrying a delivery which failed
+// the given number of times: doubled after each failure, up to a maximum.
+func WebhookRetryDelay(config *Config, attempts int) time.Duration {
+	delay := config.WebhookRetryDelay
+
+	for i := 1; i < attempts && delay < config.WebhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > config.WebhookMaxRetryDelay {
+		delay = config.WebhookMaxRetryDelay
+	}
+
+	return delay
+}
+
+// dispatcher delivers to each webhook from its own goroutine, and keeps
+// track of the webhooks being delivered to, and of the ones backing off
+// after a failure, so the next scans of the queue skip their deliveries.
+type dispatcher struct {
+	config *Config
+	db     Store
+	client *http.Client
+
+	mu      sync.Mutex
+	busy    map[string]bool
+	retryAt map[string]time.Time
+}
+
+// skipped returns the webhooks whose deliveries must not be sent now.
+func (d *dispatcher) skipped(now time.Time) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ids := make([]string, 0, len(d.busy)+len(d.retryAt))
+	for id := range d.busy {
+		ids = append(ids, id)
+	}
+
+	for id, at := range d.retryAt {
+		if now.After(at) {
+			delete(d.retryAt, id)
+		} else if false == d.busy[id] {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// dispatch starts sending the deliveries due, up to WEBHOOK_CONCURRENCY
+// webhooks at once. The deliveries of a webhook are sent in order.
+func (d *dispatcher) dispatch() error {
+	deliveries, err := d.db.GetDueDeliveries(time.Now().Unix(), WEBHOOK_BATCH_SIZE, d.skipped(time.Now()))
+	if err != nil || len(deliveries) == 0 {
+		return err
+	}
+
+	hooks, err := d.db.GetWebhooks()
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[string]Webhook)
+	for _, hook := range hooks {
+		byID[hook.ID] = hook
+	}
+
+	queued := make(map[string][]WebhookDelivery)
+	order := make([]string, 0)
+
+	for _, delivery := range deliveries {
+		if _, ok := byID[delivery.WebhookID]; false == ok {
+			delivery.Attempts++
+			delivery.Status = DELIVERY_DEAD
+			delivery.LastError = "Webhook was removed"
+
+			err = d.db.UpdateDelivery(delivery)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, ok := queued[delivery.WebhookID]; false == ok {
+			order = append(order, delivery.WebhookID)
+		}
+
+		queued[delivery.WebhookID] = append(queued[delivery.WebhookID], delivery)
+	}
+
+	for _, id := range order {
+		d.mu.Lock()
+		if len(d.busy) >= WEBHOOK_CONCURRENCY {
+			d.mu.Unlock()
+			break
+		}
+		d.busy[id] = true
+		d.mu.Unlock()
+
+		go d.deliver(byID[id], queued[id])
+	}
+
+	return nil
+}
+
+// deliver sends the deliveries of a webhook until one fails: the webhook then
+// backs off until the failed delivery is retried.
+func (d *dispatcher) deliver(hook Webhook, deliveries []WebhookDelivery) {
+	defer func() {
+		d.mu.Lock()
+		delete(d.busy, hook.ID)
+		d.mu.Unlock()
+	}()
+
+	for _, delivery := range deliveries {
+		err := DeliverWebhook(d.client, hook, delivery)
+
+		delivery.Attempts++
+
+		if err == nil {
+			delivery.Status = DELIVERY_DELIVERED
+			delivery.LastError = ""
+		} else {
+			delay := WebhookRetryDelay(d.config, delivery.Attempts)
+
+			delivery.LastError = err.Error()
+			delivery.NextAttemptAt = time.Now().Add(delay).Unix()
+
+			if delivery.Attempts >= d.config.WebhookMaxAttempts {
+				log.Printf("Webhook delivery %d to %s is dead after %d attempts: %v", delivery.ID, delivery.WebhookID, delivery.Attempts, err)
+				delivery.Status = DELIVERY_DEAD
+			}
+
+			d.mu.Lock()
+			d.retryAt[hook.ID] = time.Now().Add(delay)
+			d.mu.Unlock()
+		}
+
+		updateErr := d.db.UpdateDelivery(delivery)
+		if updateErr != nil {
+			log.Println("WebhookDispatcher:", updateErr)
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// WebhookDispatcher delivers queued notifications to webhooks. A slow or
+// failing webhook only delays its own deliveries.
+func WebhookDispatcher(config *Config, db Store) {
+	d := &dispatcher{
+		config:  config,
+		db:      db,
+		client:  &http.Client{Timeout: config.WebhookTimeout},
+		busy:    make(map[string]bool),
+		retryAt: make(map[string]time.Time),
+	}
+
+	for {
+		err := d.dispatch()
+		if err != nil {
+			log.Println("WebhookDispatcher:", err)
+		}
+
+		time.Sleep(WEBHOOK_POLL_INTERVAL)
+	}
+}